@@ -29,20 +29,57 @@ type GitopsAPISpec struct {
 	GitRepository string `json:"gitRepository,omitempty"`
 	GitUser       string `json:"gitUser,omitempty"`
 	GitEmail      string `json:"gitEmail,omitempty"`
+	// The git provider hosting the repository, inferred from the repository URL if not specified.
+	// Bitbucket Server repositories cannot be inferred and require bitbucket-server, GitHub Enterprise
+	// Server repositories require github unless hosted on a github.* domain.
+	// Repositories on other hosts default to git, which pushes without opening pull requests
+	// +kubebuilder:validation:Enum=github;gitlab;gitea;bitbucket-server;azure-devops;git
+	// +optional
+	Provider string `json:"provider,omitempty"`
+	// The base URL of the GitHub API, defaults to https://api.github.com for github.com and
+	// to <host>/api/v3 for GitHub Enterprise Server
+	// +optional
+	APIURL string `json:"apiURL,omitempty"`
 	// The branch to use as a baseline for the new branch, defaults to master
 	Base string `json:"base,omitempty"`
-	// The branch to push updates back to, defaults to master
+	// The branch to push updates back to, can be templated from the submitted object. Defaults to the
+	// base branch, or to a slug of the pull request title if a pull request is opened. Commits are appended
+	// to the branch if it already exists, and an open pull request from it is updated rather than duplicated.
+	// If the pull request from the branch was closed or merged, a new branch suffixed with -2, -3, ... is used
 	Branch string `json:"branch,omitempty"`
 
 	// Open a new Pull request from the branch back to the base
 	PullRequest *PullRequestTemplate `json:"pullRequest,omitempty"`
 
+	// Accumulate requests for the same branch and commit them together, in a single commit and pull
+	// request. Batched requests return a pending ID that can be polled at /_pending/:id
+	// +optional
+	Batch *BatchSpec `json:"batch,omitempty"`
+
+	// Delete the branches of pull requests opened by the GitopsAPI when it is deleted, open pull
+	// requests are always closed
+	// +optional
+	DeleteBranches bool `json:"deleteBranches,omitempty"`
+
 	// The secret name containing the Git credentials.
 	// For SSH repositories the secret must contain SSH_PRIVATE_KEY, SSH_PRIVATE_KEY_PASSORD
-	// For Github repositories it must contain GITHUB_TOKEN
+	// and SSH_KNOWN_HOSTS, unless the operator is configured with a known hosts ConfigMap
+	// For Github repositories it must contain GITHUB_TOKEN, or GITHUB_APP_ID, GITHUB_APP_INSTALLATION_ID
+	// and GITHUB_APP_PRIVATE_KEY to authenticate as a GitHub App installation
+	// For Gitlab repositories it must contain GITLAB_TOKEN
+	// For Gitea repositories it must contain GITEA_TOKEN
+	// For Bitbucket Server repositories it must contain an HTTP access token in BITBUCKET_TOKEN,
+	// and optionally BITBUCKET_USERNAME to authenticate git operations using basic auth
+	// For Azure DevOps repositories it must contain a personal access token in AZURE_DEVOPS_TOKEN
+	// For other git repositories over HTTP(S) it must contain either a bearer token in GIT_TOKEN
+	// or GIT_USERNAME and GIT_PASSWORD
 	// +optional
 	SecretRef *corev1.LocalObjectReference `json:"secretRef,omitempty"`
 
+	// Skip verification of SSH host keys, this is insecure and should only be used for testing
+	// +optional
+	SSHInsecureIgnoreHostKey bool `json:"sshInsecureIgnoreHostKey,omitempty"`
+
 	// The secret name containing the static credential to authenticate agaist either
 	// as a `Authorization: Bearer` header or as a `?token=` argument
 	// Must contain a key called TOKEN
@@ -62,19 +99,79 @@ type GitopsAPISpec struct {
 	SearchPath string `json:"searchPath,omitempty"`
 }
 
+type BatchSpec struct {
+	// How long requests are accumulated for, starting from the first request of a batch
+	// +required
+	Window metav1.Duration `json:"window"`
+	// Commit the batch before the window ends once it contains this many objects, 0 is unlimited
+	// +optional
+	MaxObjects int `json:"maxObjects,omitempty"`
+}
+
 type PullRequestTemplate struct {
 	Body      string   `json:"body,omitempty"`
 	Title     string   `json:"title,omitempty"`
 	Reviewers []string `json:"reviewers,omitempty"`
 	Assignees []string `json:"assignees,omitempty"`
-	Tags      []string `json:"tags,omitempty"`
+	// Labels to add to the pull request, created if missing. Like the title and body each tag can be
+	// templated from the submitted object, tags that template to an empty string are skipped
+	Tags []string `json:"tags,omitempty"`
+	// Open the pull request as a draft, where supported by the provider
+	// +optional
+	Draft bool `json:"draft,omitempty"`
+	// Merge the pull request automatically once required reviews and checks pass, where supported by
+	// the provider. Auto merge is not enabled for draft pull requests
+	// +optional
+	AutoMerge bool `json:"autoMerge,omitempty"`
+	// The method used to auto merge the pull request, defaults to merge
+	// +kubebuilder:validation:Enum=merge;squash;rebase
+	// +optional
+	MergeMethod string `json:"mergeMethod,omitempty"`
+}
+
+const (
+	MergeMethodMerge  = "merge"
+	MergeMethodSquash = "squash"
+	MergeMethodRebase = "rebase"
+)
+
+const (
+	PullRequestStateOpen   = "open"
+	PullRequestStateMerged = "merged"
+	PullRequestStateClosed = "closed"
+)
+
+// PullRequestStatus is the observed state of a pull request opened by the GitopsAPI
+type PullRequestStatus struct {
+	Number int    `json:"number"`
+	URL    string `json:"url,omitempty"`
+	// The branch the pull request was opened from
+	Head string `json:"head,omitempty"`
+	// +kubebuilder:validation:Enum=open;merged;closed
+	State string `json:"state,omitempty"`
+	// The time the pull request was merged, where reported by the provider
+	// +optional
+	MergedAt *metav1.Time `json:"mergedAt,omitempty"`
+	// The SHA of the most recent commit on the head branch
+	SHA string `json:"sha,omitempty"`
 }
 
 // GitopsAPIStatus defines the observed state of GitopsAPI
 type GitopsAPIStatus struct {
+	// The open and most recent pull requests opened by the GitopsAPI, newest first
+	// +optional
+	PullRequests []PullRequestStatus `json:"pullRequests,omitempty"`
+	// The number of pull requests that are still open
+	// +optional
+	OpenPullRequests int `json:"openPullRequests,omitempty"`
 }
 
 // +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Repository",type=string,JSONPath=`.spec.gitRepository`
+// +kubebuilder:printcolumn:name="Open PRs",type=integer,JSONPath=`.status.openPullRequests`
+// +kubebuilder:printcolumn:name="Last PR",type=string,JSONPath=`.status.pullRequests[0].url`,priority=1
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
 
 // GitopsAPI is the Schema for the gitopsapis API
 type GitopsAPI struct {
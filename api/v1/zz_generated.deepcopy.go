@@ -25,13 +25,29 @@ import (
 	"k8s.io/apimachinery/pkg/runtime"
 )
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BatchSpec) DeepCopyInto(out *BatchSpec) {
+	*out = *in
+	out.Window = in.Window
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BatchSpec.
+func (in *BatchSpec) DeepCopy() *BatchSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(BatchSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *GitopsAPI) DeepCopyInto(out *GitopsAPI) {
 	*out = *in
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
 	in.Spec.DeepCopyInto(&out.Spec)
-	out.Status = in.Status
+	in.Status.DeepCopyInto(&out.Status)
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GitopsAPI.
@@ -92,6 +108,11 @@ func (in *GitopsAPISpec) DeepCopyInto(out *GitopsAPISpec) {
 		*out = new(PullRequestTemplate)
 		(*in).DeepCopyInto(*out)
 	}
+	if in.Batch != nil {
+		in, out := &in.Batch, &out.Batch
+		*out = new(BatchSpec)
+		**out = **in
+	}
 	if in.SecretRef != nil {
 		in, out := &in.SecretRef, &out.SecretRef
 		*out = new(corev1.LocalObjectReference)
@@ -122,6 +143,13 @@ func (in *GitopsAPISpec) DeepCopy() *GitopsAPISpec {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *GitopsAPIStatus) DeepCopyInto(out *GitopsAPIStatus) {
 	*out = *in
+	if in.PullRequests != nil {
+		in, out := &in.PullRequests, &out.PullRequests
+		*out = make([]PullRequestStatus, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GitopsAPIStatus.
@@ -134,6 +162,25 @@ func (in *GitopsAPIStatus) DeepCopy() *GitopsAPIStatus {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PullRequestStatus) DeepCopyInto(out *PullRequestStatus) {
+	*out = *in
+	if in.MergedAt != nil {
+		in, out := &in.MergedAt, &out.MergedAt
+		*out = (*in).DeepCopy()
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PullRequestStatus.
+func (in *PullRequestStatus) DeepCopy() *PullRequestStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(PullRequestStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *PullRequestTemplate) DeepCopyInto(out *PullRequestTemplate) {
 	*out = *in
@@ -0,0 +1,299 @@
+package connectors
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	nethttp "net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	gitv1 "github.com/flanksource/git-operator/api/v1"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	azureAPIVersion = "6.0"
+	// the pull request labels API is only available as a preview
+	azureLabelsAPIVersion = "6.0-preview.1"
+)
+
+type AzureDevOps struct {
+	gitRepository
+	k8sCrd client.Client
+	http   *nethttp.Client
+	token  string
+	// the base URL of the repositories API e.g. https://dev.azure.com/org/project/_apis/git/repositories/repo
+	api string
+	// the base URL of the identities API e.g. https://vssps.dev.azure.com/org/_apis/identities
+	identities string
+}
+
+// NewAzureDevOps creates a connector for an Azure DevOps Repos repository using a personal access token,
+// server and repository are as returned by parseRepositoryURL for either a dev.azure.com or visualstudio.com URL
+func NewAzureDevOps(client client.Client, log logr.Logger, server, repository, token string) (Connector, error) {
+	parts := strings.Split(repository, "/_git/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, errors.Errorf("invalid azure devops repository %s, expected [org/]project/_git/repo", repository)
+	}
+	org := strings.Split(parts[0], "/")[0]
+	if !strings.HasPrefix(server, "https://dev.azure.com") {
+		org = strings.Split(strings.TrimPrefix(server, "https://"), ".")[0]
+	}
+
+	azure := &AzureDevOps{
+		gitRepository: gitRepository{
+			Logger: log.WithName("AzureDevOps").WithName(repository),
+			url:    fmt.Sprintf("%s/%s", server, repository),
+			auth:   &http.BasicAuth{Username: "git-operator", Password: token},
+			// Azure DevOps requires multi_ack
+			multiAck: true,
+		},
+		k8sCrd:     client,
+		http:       &nethttp.Client{},
+		token:      token,
+		api:        fmt.Sprintf("%s/%s/_apis/git/repositories/%s", server, parts[0], parts[1]),
+		identities: fmt.Sprintf("https://vssps.dev.azure.com/%s/_apis/identities", org),
+	}
+	azure.pullRequestClosed = func(ctx context.Context, base, head string) (bool, error) {
+		if id, err := azure.findPullRequest(ctx, base, head, "active"); err != nil || id != 0 {
+			return false, err
+		}
+		id, err := azure.findPullRequest(ctx, base, head, "all")
+		return id != 0, err
+	}
+	return azure, nil
+}
+
+func (g *AzureDevOps) OpenPullRequest(ctx context.Context, base string, head string, spec *gitv1.PullRequestTemplate) (int, error) {
+	if spec.Title == "" {
+		spec.Title = head
+	}
+	reviewers := []map[string]interface{}{}
+	for _, login := range spec.Reviewers {
+		id, err := g.findIdentity(ctx, login)
+		if err != nil {
+			return 0, err
+		}
+		reviewers = append(reviewers, map[string]interface{}{"id": id, "isRequired": true})
+	}
+	if len(spec.Assignees) > 0 {
+		g.Info("Azure DevOps does not support assignees, ignoring", "assignees", spec.Assignees)
+	}
+
+	existing, err := g.findPullRequest(ctx, base, head, "active")
+	if err != nil {
+		return 0, err
+	}
+	if existing != 0 {
+		g.Info("Updating existing PR", "pr", existing)
+		if err := g.do(ctx, "PATCH", fmt.Sprintf("%s/pullrequests/%d", g.api, existing), map[string]string{
+			"title":       spec.Title,
+			"description": spec.Body,
+		}, nil); err != nil {
+			return 0, errors.Wrapf(err, "failed to update pr %d", existing)
+		}
+		// reviewers and labels are templated, so each request can add new ones
+		for _, reviewer := range reviewers {
+			if err := g.do(ctx, "PUT", fmt.Sprintf("%s/pullrequests/%d/reviewers/%s", g.api, existing, reviewer["id"]), reviewer, nil); err != nil {
+				return 0, errors.Wrapf(err, "failed to add reviewer %s", reviewer["id"])
+			}
+		}
+		if err := g.addLabels(ctx, existing, spec.Tags); err != nil {
+			return 0, err
+		}
+		return existing, g.autoComplete(ctx, existing, spec)
+	}
+
+	g.V(1).Info("Creating PR", "title", spec.Title, "head", head, "base", base)
+	pr := struct {
+		PullRequestID int `json:"pullRequestId"`
+	}{}
+	if err := g.do(ctx, "POST", g.api+"/pullrequests", map[string]interface{}{
+		"sourceRefName": "refs/heads/" + head,
+		"targetRefName": "refs/heads/" + base,
+		"title":         spec.Title,
+		"description":   spec.Body,
+		"reviewers":     reviewers,
+		"isDraft":       spec.Draft,
+	}, &pr); err != nil {
+		return 0, errors.Wrapf(err, "failed to create pr title=%s, head=%s base=%s", spec.Title, head, base)
+	}
+	g.Info("PR created", "pr", pr.PullRequestID)
+
+	if err := g.addLabels(ctx, pr.PullRequestID, spec.Tags); err != nil {
+		return 0, err
+	}
+	return pr.PullRequestID, g.autoComplete(ctx, pr.PullRequestID, spec)
+}
+
+// addLabels adds labels to a pull request, labels that do not exist yet are created by the API
+func (g *AzureDevOps) addLabels(ctx context.Context, id int, labels []string) error {
+	for _, label := range labels {
+		if err := g.do(ctx, "POST", fmt.Sprintf("%s/pullrequests/%d/labels?api-version=%s", g.api, id, azureLabelsAPIVersion), map[string]string{"name": label}, nil); err != nil {
+			return errors.Wrapf(err, "failed to add label %s", label)
+		}
+	}
+	return nil
+}
+
+// azureMergeStrategies maps merge methods onto Azure DevOps merge strategies
+var azureMergeStrategies = map[string]string{
+	gitv1.MergeMethodMerge:  "noFastForward",
+	gitv1.MergeMethodSquash: "squash",
+	gitv1.MergeMethodRebase: "rebase",
+}
+
+// autoComplete sets the pull request to complete once all policies pass, on behalf of its creator
+func (g *AzureDevOps) autoComplete(ctx context.Context, id int, spec *gitv1.PullRequestTemplate) error {
+	if !spec.AutoMerge {
+		return nil
+	}
+	if spec.Draft {
+		g.Info("Draft PRs cannot be auto merged, ignoring", "pr", id)
+		return nil
+	}
+	method := spec.MergeMethod
+	if method == "" {
+		method = gitv1.MergeMethodMerge
+	}
+	pr := struct {
+		CreatedBy struct {
+			ID string `json:"id"`
+		} `json:"createdBy"`
+	}{}
+	path := fmt.Sprintf("%s/pullrequests/%d", g.api, id)
+	if err := g.do(ctx, "GET", path, nil, &pr); err != nil {
+		return errors.Wrapf(err, "failed to get pull request %d", id)
+	}
+	g.Info("Enabling auto complete", "pr", id, "method", method)
+	if err := g.do(ctx, "PATCH", path, map[string]interface{}{
+		"autoCompleteSetBy": map[string]string{"id": pr.CreatedBy.ID},
+		"completionOptions": map[string]string{"mergeStrategy": azureMergeStrategies[method]},
+	}, nil); err != nil {
+		return errors.Wrapf(err, "failed to enable auto complete for pull request %d", id)
+	}
+	return nil
+}
+
+// ClosePullRequest abandons the pull request
+func (g *AzureDevOps) ClosePullRequest(ctx context.Context, id int) error {
+	if err := g.do(ctx, "PATCH", fmt.Sprintf("%s/pullrequests/%d", g.api, id), map[string]string{"status": "abandoned"}, nil); err != nil {
+		return errors.Wrapf(err, "failed to abandon pull request %d", id)
+	}
+	return nil
+}
+
+func (g *AzureDevOps) GetPullRequest(ctx context.Context, id int) (*gitv1.PullRequestStatus, error) {
+	pr := struct {
+		Status                string     `json:"status"`
+		SourceRefName         string     `json:"sourceRefName"`
+		ClosedDate            *time.Time `json:"closedDate"`
+		LastMergeSourceCommit struct {
+			CommitID string `json:"commitId"`
+		} `json:"lastMergeSourceCommit"`
+	}{}
+	if err := g.do(ctx, "GET", fmt.Sprintf("%s/pullrequests/%d", g.api, id), nil, &pr); err != nil {
+		return nil, errors.Wrapf(err, "failed to get pull request %d", id)
+	}
+	status := &gitv1.PullRequestStatus{
+		Number: id,
+		URL:    fmt.Sprintf("%s/pullrequest/%d", g.url, id),
+		Head:   strings.TrimPrefix(pr.SourceRefName, "refs/heads/"),
+		SHA:    pr.LastMergeSourceCommit.CommitID,
+		State:  gitv1.PullRequestStateOpen,
+	}
+	switch pr.Status {
+	case "completed":
+		status.State = gitv1.PullRequestStateMerged
+		if pr.ClosedDate != nil {
+			status.MergedAt = &metav1.Time{Time: *pr.ClosedDate}
+		}
+	case "abandoned":
+		status.State = gitv1.PullRequestStateClosed
+	}
+	return status, nil
+}
+
+// findPullRequest returns the id of the most recent pull request from head into base in status, one of
+// active, abandoned, completed or all, or 0 if there is none
+func (g *AzureDevOps) findPullRequest(ctx context.Context, base, head, status string) (int, error) {
+	prs := struct {
+		Value []struct {
+			PullRequestID int `json:"pullRequestId"`
+		} `json:"value"`
+	}{}
+	path := fmt.Sprintf("%s/pullrequests?searchCriteria.status=%s&searchCriteria.sourceRefName=%s&searchCriteria.targetRefName=%s",
+		g.api, status, url.QueryEscape("refs/heads/"+head), url.QueryEscape("refs/heads/"+base))
+	if err := g.do(ctx, "GET", path, nil, &prs); err != nil {
+		return 0, errors.Wrap(err, "failed to list pull requests")
+	}
+	if len(prs.Value) == 0 {
+		return 0, nil
+	}
+	return prs.Value[0].PullRequestID, nil
+}
+
+// findIdentity returns the id of the user or group matching login e.g. an email address or display name
+func (g *AzureDevOps) findIdentity(ctx context.Context, login string) (string, error) {
+	identities := struct {
+		Value []struct {
+			ID string `json:"id"`
+		} `json:"value"`
+	}{}
+	path := fmt.Sprintf("%s?searchFilter=General&filterValue=%s", g.identities, url.QueryEscape(login))
+	if err := g.do(ctx, "GET", path, nil, &identities); err != nil {
+		return "", errors.Wrapf(err, "failed to find identity %s", login)
+	}
+	if len(identities.Value) == 0 {
+		return "", errors.Errorf("identity %s not found", login)
+	}
+	return identities.Value[0].ID, nil
+}
+
+func (g *AzureDevOps) do(ctx context.Context, method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	// paths without an api-version use azureAPIVersion
+	if !strings.Contains(path, "api-version=") {
+		separator := "?"
+		if strings.Contains(path, "?") {
+			separator = "&"
+		}
+		path += separator + "api-version=" + azureAPIVersion
+	}
+	req, err := nethttp.NewRequestWithContext(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth("", g.token)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+	res, err := g.http.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "%s %s failed", method, path)
+	}
+	defer res.Body.Close() // nolint: errcheck
+	if res.StatusCode >= 300 {
+		data, _ := ioutil.ReadAll(res.Body)
+		return errors.Errorf("%s %s failed with %d: %s", method, path, res.StatusCode, string(data))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
@@ -0,0 +1,55 @@
+package connectors
+
+import (
+	"testing"
+
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+func TestNewAzureDevOps(t *testing.T) {
+	tests := []struct {
+		server     string
+		repository string
+		url        string
+		api        string
+		identities string
+		err        bool
+	}{
+		{
+			server:     "https://dev.azure.com",
+			repository: "org/project/_git/repo",
+			url:        "https://dev.azure.com/org/project/_git/repo",
+			api:        "https://dev.azure.com/org/project/_apis/git/repositories/repo",
+			identities: "https://vssps.dev.azure.com/org/_apis/identities",
+		},
+		{
+			server:     "https://org.visualstudio.com",
+			repository: "project/_git/repo",
+			url:        "https://org.visualstudio.com/project/_git/repo",
+			api:        "https://org.visualstudio.com/project/_apis/git/repositories/repo",
+			identities: "https://vssps.dev.azure.com/org/_apis/identities",
+		},
+		{server: "https://dev.azure.com", repository: "org/project/repo", err: true},
+		{server: "https://dev.azure.com", repository: "org/project/_git/", err: true},
+	}
+	for _, test := range tests {
+		connector, err := NewAzureDevOps(nil, logf.Log, test.server, test.repository, "token")
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.repository)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.repository, err)
+			continue
+		}
+		azure := connector.(*AzureDevOps)
+		if !azure.multiAck {
+			t.Errorf("%s: expected multi_ack to be enabled", test.repository)
+		}
+		if azure.url != test.url || azure.api != test.api || azure.identities != test.identities {
+			t.Errorf("%s: expected %s %s %s, got %s %s %s", test.repository, test.url, test.api, test.identities, azure.url, azure.api, azure.identities)
+		}
+	}
+}
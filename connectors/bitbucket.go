@@ -0,0 +1,147 @@
+package connectors
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-logr/logr"
+	"github.com/jenkins-x/go-scm/scm"
+	"github.com/jenkins-x/go-scm/scm/factory"
+	"github.com/pkg/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+type BitbucketServer struct {
+	*scmConnector
+	project string
+	slug    string
+}
+
+// NewBitbucketServer creates a connector for a Bitbucket Server / Data Center repository using an HTTP access token,
+// server is the base URL of the instance including any context path and repository is PROJECT/slug
+func NewBitbucketServer(client client.Client, log logr.Logger, server, repository, username, token string) (Connector, error) {
+	scmClient, err := factory.NewClient("stash", server, token)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create bitbucket server client")
+	}
+
+	cloneURL := fmt.Sprintf("%s/scm/%s.git", server, repository)
+	var auth transport.AuthMethod = &http.TokenAuth{Token: token}
+	if username != "" {
+		auth = &http.BasicAuth{Username: username, Password: token}
+	}
+	project, slug := scm.Split(repository)
+	bitbucket := &BitbucketServer{
+		scmConnector: newSCMConnector(client, log.WithName("BitbucketServer").WithName(repository), scmClient, cloneURL, repository, auth),
+		project:      project,
+		slug:         slug,
+	}
+	bitbucket.requestReview = bitbucket.addReviewers
+	// go-scm ignores the page when listing pull requests and keeps returning the first page
+	bitbucket.findPullRequest = func(ctx context.Context, base, head string) (*scm.PullRequest, error) {
+		return bitbucket.findPullRequestInState(ctx, base, head, "OPEN")
+	}
+	bitbucket.findClosedPullRequest = func(ctx context.Context, base, head string) (*scm.PullRequest, error) {
+		return bitbucket.findPullRequestInState(ctx, base, head, "ALL")
+	}
+	// go-scm emulates labels with /jx-label comments, Bitbucket Server has no labels on pull requests
+	bitbucket.addLabel = nil
+	bitbucket.mergedAt = bitbucket.getClosedDate
+	return bitbucket, nil
+}
+
+// ClosePullRequest declines the pull request, which requires the current version of the pull request
+func (g *BitbucketServer) ClosePullRequest(ctx context.Context, id int) error {
+	pr := struct {
+		Version int `json:"version"`
+	}{}
+	if err := g.do(ctx, "GET", g.pullRequestPath(id), nil, &pr); err != nil {
+		return errors.Wrapf(err, "failed to get pull request %d", id)
+	}
+	if err := g.do(ctx, "POST", fmt.Sprintf("%s/decline?version=%d", g.pullRequestPath(id), pr.Version), nil, nil); err != nil {
+		return errors.Wrapf(err, "failed to decline pull request %d", id)
+	}
+	return nil
+}
+
+// findPullRequestInState returns the first pull request from head into base in state, one of OPEN, DECLINED,
+// MERGED or ALL, or nil if there is none
+func (g *BitbucketServer) findPullRequestInState(ctx context.Context, base, head, state string) (*scm.PullRequest, error) {
+	start := 0
+	for {
+		page := struct {
+			Values []struct {
+				ID    int `json:"id"`
+				ToRef struct {
+					ID string `json:"id"`
+				} `json:"toRef"`
+			} `json:"values"`
+			IsLastPage    bool `json:"isLastPage"`
+			NextPageStart int  `json:"nextPageStart"`
+		}{}
+		path := fmt.Sprintf("rest/api/1.0/projects/%s/repos/%s/pull-requests?state=%s&direction=OUTGOING&at=%s&start=%d",
+			url.PathEscape(g.project), url.PathEscape(g.slug), state, url.QueryEscape("refs/heads/"+head), start)
+		if err := g.do(ctx, "GET", path, nil, &page); err != nil {
+			return nil, errors.Wrapf(err, "failed to list pull requests for %s", g.repository)
+		}
+		for _, pr := range page.Values {
+			if pr.ToRef.ID == "refs/heads/"+base {
+				return &scm.PullRequest{Number: pr.ID, Source: head, Target: base}, nil
+			}
+		}
+		if page.IsLastPage || page.NextPageStart <= start {
+			return nil, nil
+		}
+		start = page.NextPageStart
+	}
+}
+
+// addReviewers adds users as reviewers, go-scm adds them as participants without the REVIEWER role
+func (g *BitbucketServer) addReviewers(ctx context.Context, repo string, number int, logins []string) (*scm.Response, error) {
+	for _, login := range logins {
+		participant := map[string]interface{}{
+			"user": map[string]string{"name": login},
+			"role": "REVIEWER",
+		}
+		if err := g.do(ctx, "POST", g.pullRequestPath(number)+"/participants", participant, nil); err != nil {
+			return nil, errors.Wrapf(err, "failed to add reviewer %s", login)
+		}
+	}
+	return nil, nil
+}
+
+// getClosedDate returns when a pull request was closed, which for a merged pull request is the merge time
+func (g *BitbucketServer) getClosedDate(ctx context.Context, number int) (*time.Time, error) {
+	pr := struct {
+		ClosedDate int64 `json:"closedDate"`
+	}{}
+	if err := g.do(ctx, "GET", g.pullRequestPath(number), nil, &pr); err != nil {
+		return nil, err
+	}
+	if pr.ClosedDate == 0 {
+		return nil, nil
+	}
+	// Bitbucket Server reports timestamps in milliseconds since the epoch
+	closed := time.Unix(0, pr.ClosedDate*int64(time.Millisecond))
+	return &closed, nil
+}
+
+func (g *BitbucketServer) pullRequestPath(id int) string {
+	return fmt.Sprintf("rest/api/1.0/projects/%s/repos/%s/pull-requests/%d", url.PathEscape(g.project), url.PathEscape(g.slug), id)
+}
+
+// parseBitbucketServerPath splits the path of a Bitbucket Server clone URL e.g. [context/]scm/PROJECT/slug
+// into the context path of the instance and the PROJECT/slug repository
+func parseBitbucketServerPath(path string) (contextPath string, repository string, err error) {
+	parts := strings.Split(path, "/")
+	n := len(parts)
+	if n < 3 || parts[n-3] != "scm" {
+		return "", "", errors.Errorf("invalid bitbucket server repository path %s, expected [context/]scm/PROJECT/repo", path)
+	}
+	return strings.Join(parts[:n-3], "/"), strings.Join(parts[n-2:], "/"), nil
+}
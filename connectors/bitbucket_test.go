@@ -0,0 +1,34 @@
+package connectors
+
+import "testing"
+
+func TestParseBitbucketServerPath(t *testing.T) {
+	tests := []struct {
+		path        string
+		contextPath string
+		repository  string
+		err         bool
+	}{
+		{path: "scm/PROJ/repo", repository: "PROJ/repo"},
+		{path: "bitbucket/scm/PROJ/repo", contextPath: "bitbucket", repository: "PROJ/repo"},
+		{path: "a/b/scm/~user/repo", contextPath: "a/b", repository: "~user/repo"},
+		{path: "projects/PROJ/repos/repo", err: true},
+		{path: "PROJ/repo", err: true},
+	}
+	for _, test := range tests {
+		contextPath, repository, err := parseBitbucketServerPath(test.path)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.path)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.path, err)
+			continue
+		}
+		if contextPath != test.contextPath || repository != test.repository {
+			t.Errorf("%s: expected %s %s, got %s %s", test.path, test.contextPath, test.repository, contextPath, repository)
+		}
+	}
+}
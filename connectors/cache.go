@@ -0,0 +1,188 @@
+package connectors
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/osfs"
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+)
+
+// CacheDir is the directory repositories are cached in between requests, if empty every
+// request clones the repository into a new temporary directory
+var CacheDir string
+
+// CacheMaxAge is how long a cached repository is kept without being used before EvictCache removes it,
+// 0 keeps cached repositories forever
+var CacheMaxAge time.Duration
+
+var (
+	cacheLocksLock sync.Mutex
+	// cacheLocks serializes access to each cached repository, keyed by directory
+	cacheLocks = map[string]*sync.Mutex{}
+)
+
+func cacheLock(dir string) *sync.Mutex {
+	cacheLocksLock.Lock()
+	defer cacheLocksLock.Unlock()
+	if _, found := cacheLocks[dir]; !found {
+		cacheLocks[dir] = &sync.Mutex{}
+	}
+	return cacheLocks[dir]
+}
+
+// checkoutCached fetches the cached repository for url, cloning it if it is not cached yet, and checks
+// out local using resetBranch. The repository stays locked until release is called.
+func checkoutCached(ctx context.Context, log logr.Logger, url string, auth transport.AuthMethod, branch, local string) (billy.Filesystem, *git.Repository, *git.Worktree, func(), error) {
+	hash := sha256.Sum256([]byte(url))
+	dir := filepath.Join(CacheDir, hex.EncodeToString(hash[:8]))
+	lock := cacheLock(dir)
+	lock.Lock()
+
+	repo, err := fetchCached(ctx, log, dir, url, auth)
+	if err != nil {
+		lock.Unlock()
+		return nil, nil, nil, nil, err
+	}
+	// the modification time of the directory records when the repository was last used
+	now := time.Now()
+	if err := os.Chtimes(dir, now, now); err != nil {
+		log.Error(err, "failed to update the modification time", "dir", dir)
+	}
+	work, err := resetBranch(log, repo, branch, local)
+	if err != nil {
+		lock.Unlock()
+		return nil, nil, nil, nil, err
+	}
+	return osfs.New(dir), repo, work, lock.Unlock, nil
+}
+
+// fetchCached opens and fetches the repository cached in dir, cloning it if it is missing or cannot be opened
+func fetchCached(ctx context.Context, log logr.Logger, dir, url string, auth transport.AuthMethod) (*git.Repository, error) {
+	repo, err := git.PlainOpen(dir)
+	if err != nil {
+		if err != git.ErrRepositoryNotExists {
+			log.Error(err, "failed to open cached repository, cloning again", "dir", dir)
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			return nil, errors.Wrapf(err, "failed to remove %s", dir)
+		}
+		log.Info("Cloning into cache", "dir", dir)
+		repo, err = git.PlainCloneContext(ctx, dir, false, &git.CloneOptions{
+			URL:      url,
+			Depth:    CloneDepth,
+			Progress: os.Stdout,
+			Auth:     auth,
+		})
+		if err != nil {
+			os.RemoveAll(dir) // nolint: errcheck
+			return nil, errors.Wrapf(err, "failed to clone %s", url)
+		}
+		return repo, nil
+	}
+
+	log.Info("Fetching", "dir", dir, "depth", CloneDepth)
+	err = repo.FetchContext(ctx, &git.FetchOptions{
+		RefSpecs: []config.RefSpec{"+refs/heads/*:refs/remotes/origin/*"},
+		Depth:    CloneDepth,
+		Auth:     auth,
+		Progress: os.Stdout,
+		Force:    true,
+	})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return nil, errors.Wrapf(err, "failed to fetch %s", url)
+	}
+	return repo, pruneBranches(repo, auth)
+}
+
+// EvictCache removes the cached repositories that were not used for CacheMaxAge
+func EvictCache(log logr.Logger) {
+	if CacheDir == "" || CacheMaxAge == 0 {
+		return
+	}
+	entries, err := ioutil.ReadDir(CacheDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Error(err, "failed to list cached repositories", "dir", CacheDir)
+		}
+		return
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && time.Since(entry.ModTime()) > CacheMaxAge {
+			evictCached(log, filepath.Join(CacheDir, entry.Name()))
+		}
+	}
+}
+
+func evictCached(log logr.Logger, dir string) {
+	lock := cacheLock(dir)
+	lock.Lock()
+	defer lock.Unlock()
+	// the repository may have been used while waiting for the lock
+	info, err := os.Stat(dir)
+	if err != nil || time.Since(info.ModTime()) <= CacheMaxAge {
+		return
+	}
+	log.Info("Evicting cached repository", "dir", dir, "lastUsed", info.ModTime())
+	if err := os.RemoveAll(dir); err != nil {
+		log.Error(err, "failed to evict cached repository", "dir", dir)
+	}
+}
+
+// pruneBranches removes remote tracking branches that no longer exist on origin, so that deleted branches
+// are not resurrected when a branch of the same name is checked out again, along with the local branches
+// checked out from them
+func pruneBranches(repo *git.Repository, auth transport.AuthMethod) error {
+	remote, err := repo.Remote(git.DefaultRemoteName)
+	if err != nil {
+		return err
+	}
+	refs, err := remote.List(&git.ListOptions{Auth: auth})
+	if err != nil {
+		return errors.Wrap(err, "failed to list remote branches")
+	}
+	branches := map[plumbing.ReferenceName]bool{}
+	for _, ref := range refs {
+		if ref.Name().IsBranch() {
+			branches[ref.Name()] = true
+			branches[plumbing.NewRemoteReferenceName(git.DefaultRemoteName, ref.Name().Short())] = true
+		}
+	}
+	local, err := repo.References()
+	if err != nil {
+		return err
+	}
+	var stale []plumbing.ReferenceName
+	if err := local.ForEach(func(ref *plumbing.Reference) error {
+		name := ref.Name()
+		if name.IsRemote() && strings.HasPrefix(name.String(), "refs/remotes/origin/") && name.Short() != "origin/HEAD" && !branches[name] {
+			stale = append(stale, name)
+		}
+		// local branches are reset to the remote branch or base when checked out, so they hold no changes
+		if name.IsBranch() && !branches[name] {
+			stale = append(stale, name)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	for _, name := range stale {
+		if err := repo.Storer.RemoveReference(name); err != nil {
+			return errors.Wrapf(err, "failed to prune %s", name)
+		}
+	}
+	return nil
+}
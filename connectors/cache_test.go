@@ -0,0 +1,138 @@
+package connectors
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// withCache caches repositories in a temporary directory for the duration of the test
+func withCache(t *testing.T, depth int) {
+	CacheDir, CloneDepth = t.TempDir(), depth
+	t.Cleanup(func() { CacheDir, CloneDepth, CacheMaxAge = "", 0, 0 })
+}
+
+func TestCheckoutCachedShallow(t *testing.T) {
+	withCache(t, 1)
+	url := newRemote(t)
+	for i := 0; i < 2; i++ {
+		repo := &gitRepository{Logger: logf.Log, url: url}
+		if _, _, err := repo.Clone(context.Background(), "master", "feature"); err != nil {
+			t.Fatal(err)
+		}
+		head := commitFile(t, repo.repo, "cached.yaml")
+		if err := repo.Push(context.Background(), "feature:master"); err != nil {
+			t.Fatal(err)
+		}
+		if remoteBranch(t, url, "feature") != head {
+			t.Errorf("expected the commit to be pushed on the %d. checkout", i+1)
+		}
+		shallow, err := repo.repo.Storer.Shallow()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(shallow) == 0 {
+			t.Errorf("expected a shallow repository on the %d. checkout", i+1)
+		}
+		repo.Close() // nolint: errcheck
+	}
+}
+
+func TestCheckoutCachedFetches(t *testing.T) {
+	withCache(t, 0)
+	url := newRemote(t)
+	repo := &gitRepository{Logger: logf.Log, url: url}
+	if _, _, err := repo.Clone(context.Background(), "master", "master"); err != nil {
+		t.Fatal(err)
+	}
+	repo.Close() // nolint: errcheck
+
+	// another clone pushes to master
+	other, err := git.PlainClone(t.TempDir(), false, &git.CloneOptions{URL: url})
+	if err != nil {
+		t.Fatal(err)
+	}
+	head := commitFile(t, other, "other.yaml")
+	if err := other.Push(&git.PushOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := repo.Clone(context.Background(), "master", "master"); err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close() // nolint: errcheck
+	ref, err := repo.repo.Reference(plumbing.NewBranchReferenceName("master"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref.Hash() != head {
+		t.Errorf("expected master to be fetched at %s, got %s", head, ref.Hash())
+	}
+}
+
+func TestCheckoutCachedPrunesBranches(t *testing.T) {
+	withCache(t, 0)
+	url := newRemote(t)
+	repo := &gitRepository{Logger: logf.Log, url: url}
+	// a work branch that was never pushed, e.g. because nothing changed
+	if _, _, err := repo.Clone(context.Background(), "master", "unpushed"); err != nil {
+		t.Fatal(err)
+	}
+	repo.Close() // nolint: errcheck
+	if err := repo.DeleteBranch(context.Background(), "feature"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := repo.Clone(context.Background(), "master", "master"); err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close() // nolint: errcheck
+	for _, name := range []plumbing.ReferenceName{
+		plumbing.NewBranchReferenceName("unpushed"),
+		plumbing.NewBranchReferenceName("feature"),
+		plumbing.NewRemoteReferenceName(git.DefaultRemoteName, "feature"),
+	} {
+		if _, err := repo.repo.Reference(name, false); err == nil {
+			t.Errorf("expected %s to be pruned", name)
+		}
+	}
+	if _, err := repo.repo.Reference(plumbing.NewBranchReferenceName("master"), false); err != nil {
+		t.Errorf("expected master to be kept: %v", err)
+	}
+}
+
+func TestEvictCache(t *testing.T) {
+	withCache(t, 0)
+	CacheMaxAge = time.Hour
+	url := newRemote(t)
+	repo := &gitRepository{Logger: logf.Log, url: url}
+	if _, _, err := repo.Clone(context.Background(), "master", "master"); err != nil {
+		t.Fatal(err)
+	}
+	repo.Close() // nolint: errcheck
+	entries, err := ioutil.ReadDir(CacheDir)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("expected a cached repository, got %v %v", entries, err)
+	}
+	cached := filepath.Join(CacheDir, entries[0].Name())
+
+	EvictCache(logf.Log)
+	if _, err := os.Stat(cached); err != nil {
+		t.Fatalf("expected a recently used repository to be kept: %v", err)
+	}
+	unused := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(cached, unused, unused); err != nil {
+		t.Fatal(err)
+	}
+	EvictCache(logf.Log)
+	if _, err := os.Stat(cached); !os.IsNotExist(err) {
+		t.Errorf("expected an unused repository to be evicted, got %v", err)
+	}
+}
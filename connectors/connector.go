@@ -2,62 +2,220 @@ package connectors
 
 import (
 	"context"
+	"fmt"
+	neturl "net/url"
+	"strconv"
 	"strings"
 
 	gitv1 "github.com/flanksource/git-operator/api/v1"
 	"github.com/go-git/go-billy/v5"
 	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
 	"github.com/go-logr/logr"
 	"github.com/pkg/errors"
-	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
+const (
+	ProviderGithub          = "github"
+	ProviderGitlab          = "gitlab"
+	ProviderGitea           = "gitea"
+	ProviderBitbucketServer = "bitbucket-server"
+	ProviderAzureDevOps     = "azure-devops"
+	ProviderGit             = "git"
+)
+
 type Connector interface {
 	Clone(ctx context.Context, branch, local string) (billy.Filesystem, *git.Worktree, error)
+	// WorkBranch returns the branch to commit to for a pull request from head into base, which is head
+	// unless its pull request was closed or merged
+	WorkBranch(ctx context.Context, base, head string) (string, error)
 	Push(ctx context.Context, branch string) error
+	// Ahead reports whether the branch checked out by Clone has commits that are not on base
+	Ahead(base string) (bool, error)
+	DeleteBranch(ctx context.Context, branch string) error
 	OpenPullRequest(ctx context.Context, base string, head string, spec *gitv1.PullRequestTemplate) (int, error)
 	ClosePullRequest(ctx context.Context, id int) error
+	GetPullRequest(ctx context.Context, id int) (*gitv1.PullRequestStatus, error)
+	// Close releases the checkout returned by Clone
+	Close() error
 }
 
-func NewConnector(ctx context.Context, crdClient client.Client, k8sClient *kubernetes.Clientset, log logr.Logger, namespace string, url string, secretRef *v1.LocalObjectReference) (Connector, error) {
+func NewConnector(ctx context.Context, crdClient client.Client, k8sClient *kubernetes.Clientset, log logr.Logger, namespace string, spec *gitv1.GitopsAPISpec) (Connector, error) {
 	if k8sClient == nil {
 		return nil, errors.New("nil k8s client")
 	}
-	secret, err := k8sClient.CoreV1().Secrets(namespace).Get(ctx, secretRef.Name, metav1.GetOptions{})
+	if spec.SecretRef == nil {
+		return nil, errors.New("secretRef is required")
+	}
+	secret, err := k8sClient.CoreV1().Secrets(namespace).Get(ctx, spec.SecretRef.Name, metav1.GetOptions{})
 	if err != nil {
-		return nil, errors.Wrapf(err, "failed to get secret %s in namespace %s", secretRef.Name, namespace)
+		return nil, errors.Wrapf(err, "failed to get secret %s in namespace %s", spec.SecretRef.Name, namespace)
+	}
+
+	url := spec.GitRepository
+	if strings.HasPrefix(url, "ssh://") {
+		sshURL, user, err := parseSSHURL(url)
+		if err != nil {
+			return nil, err
+		}
+
+		privateKey, found := secret.Data["SSH_PRIVATE_KEY"]
+		if !found {
+			return nil, ErrSSHPrivateKeyNotFoundInSecret
+		}
+		password, found := secret.Data["SSH_PRIVATE_KEY_PASSWORD"]
+		if !found {
+			password = []byte{}
+		}
+		knownHosts, err := getKnownHosts(ctx, k8sClient, secret)
+		if err != nil {
+			return nil, err
+		}
+		if len(knownHosts) == 0 && !spec.SSHInsecureIgnoreHostKey {
+			return nil, ErrSSHKnownHostsNotFound
+		}
+		return NewGitSSH(crdClient, log, sshURL, user, privateKey, string(password), knownHosts)
 	}
 
-	if strings.HasPrefix(url, "https://github.com/") {
-		path := url[19:]
-		parts := strings.Split(path, "/")
+	provider := spec.Provider
+	if provider == "" {
+		provider = providerFromURL(url)
+	}
+	if provider == ProviderGit {
+		// plain git hosts accept any repository path, so the URL is passed to go-git as is
+		if u, err := neturl.Parse(url); err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			return nil, errors.Errorf("invalid repository url: %s", url)
+		}
+		var auth transport.AuthMethod
+		if token, found := secret.Data["GIT_TOKEN"]; found {
+			auth = &http.TokenAuth{Token: string(token)}
+		} else if password, found := secret.Data["GIT_PASSWORD"]; found {
+			auth = &http.BasicAuth{Username: string(secret.Data["GIT_USERNAME"]), Password: string(password)}
+		} else {
+			return nil, ErrGitCredentialsNotFoundInSecret
+		}
+		return NewGitHTTP(crdClient, log, url, auth)
+	}
+
+	server, repository, err := parseRepositoryURL(url)
+	if err != nil {
+		return nil, err
+	}
+	switch provider {
+	case ProviderGithub:
+		parts := strings.Split(repository, "/")
 		if len(parts) != 2 {
 			return nil, errors.Errorf("invalid repository url: %s", url)
 		}
-		owner := parts[0]
-		repoName := parts[1]
-		repoName = strings.TrimSuffix(repoName, ".git")
+		if _, found := secret.Data["GITHUB_APP_ID"]; found {
+			appID, err := strconv.ParseInt(string(secret.Data["GITHUB_APP_ID"]), 10, 64)
+			if err != nil {
+				return nil, errors.Wrap(err, "invalid GITHUB_APP_ID")
+			}
+			installationID, err := strconv.ParseInt(string(secret.Data["GITHUB_APP_INSTALLATION_ID"]), 10, 64)
+			if err != nil {
+				return nil, errors.Wrap(err, "invalid GITHUB_APP_INSTALLATION_ID")
+			}
+			privateKey, found := secret.Data["GITHUB_APP_PRIVATE_KEY"]
+			if !found {
+				return nil, ErrGithubAppPrivateKeyNotFoundInSecret
+			}
+			return NewGithubApp(crdClient, log, server, spec.APIURL, parts[0], parts[1], appID, installationID, privateKey)
+		}
 		githubToken, found := secret.Data["GITHUB_TOKEN"]
 		if !found {
 			return nil, ErrGithubTokenNotFoundInSecret
 		}
-		return NewGithub(crdClient, log, owner, repoName, string(githubToken))
-	} else if strings.HasPrefix(url, "ssh://") {
-		sshURL := url[6:]
-		user := strings.Split(sshURL, "@")[0]
-
-		privateKey, found := secret.Data["SSH_PRIVATE_KEY"]
+		return NewGithub(crdClient, log, server, spec.APIURL, parts[0], parts[1], string(githubToken))
+	case ProviderGitlab:
+		gitlabToken, found := secret.Data["GITLAB_TOKEN"]
 		if !found {
-			return nil, ErrSSHPrivateKeyNotFoundInSecret
+			return nil, ErrGitlabTokenNotFoundInSecret
 		}
-		password, found := secret.Data["SSH_PRIVATE_KEY_PASSWORD"]
+		return NewGitlab(crdClient, log, server, repository, string(gitlabToken))
+	case ProviderGitea:
+		giteaToken, found := secret.Data["GITEA_TOKEN"]
 		if !found {
-			password = []byte{}
+			return nil, ErrGiteaTokenNotFoundInSecret
+		}
+		return NewGitea(crdClient, log, server, repository, string(giteaToken))
+	case ProviderBitbucketServer:
+		token, found := secret.Data["BITBUCKET_TOKEN"]
+		if !found {
+			return nil, ErrBitbucketTokenNotFoundInSecret
 		}
-		return NewGitSSH(crdClient, log, sshURL, user, privateKey, string(password))
+		contextPath, repository, err := parseBitbucketServerPath(repository)
+		if err != nil {
+			return nil, err
+		}
+		if contextPath != "" {
+			server = server + "/" + contextPath
+		}
+		return NewBitbucketServer(crdClient, log, server, repository, string(secret.Data["BITBUCKET_USERNAME"]), string(token))
+	case ProviderAzureDevOps:
+		token, found := secret.Data["AZURE_DEVOPS_TOKEN"]
+		if !found {
+			return nil, ErrAzureDevOpsTokenNotFoundInSecret
+		}
+		return NewAzureDevOps(crdClient, log, server, repository, string(token))
 	}
 	return nil, errors.New("no connector settings found")
 }
+
+// parseRepositoryURL splits a HTTP(S) repository URL into the base URL of the server and the
+// repository path e.g. https://gitlab.example.com/group/project.git -> https://gitlab.example.com, group/project
+func parseRepositoryURL(repositoryURL string) (server string, repository string, err error) {
+	u, err := neturl.Parse(repositoryURL)
+	if err != nil {
+		return "", "", errors.Wrapf(err, "invalid repository url: %s", repositoryURL)
+	}
+	repository = strings.TrimSuffix(strings.Trim(u.Path, "/"), ".git")
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" || !strings.Contains(repository, "/") {
+		return "", "", errors.Errorf("invalid repository url: %s", repositoryURL)
+	}
+	return fmt.Sprintf("%s://%s", u.Scheme, u.Host), repository, nil
+}
+
+// parseSSHURL returns the URL passed to go-git and the SSH user for an ssh:// repository URL,
+// e.g. ssh://git@host/org/repo.git -> ssh://git@host/org/repo.git, git. The non-standard
+// ssh://git@host:org/repo form is converted into the scp-like git@host:org/repo.
+func parseSSHURL(sshURL string) (url string, user string, err error) {
+	u, err := neturl.Parse(sshURL)
+	if err == nil && u.Host != "" {
+		if u.User == nil || u.User.Username() == "" {
+			return "", "", errors.Errorf("invalid repository url: %s, expected ssh://user@host/path", sshURL)
+		}
+		return sshURL, u.User.Username(), nil
+	}
+	scp := strings.TrimPrefix(sshURL, "ssh://")
+	at := strings.Index(scp, "@")
+	colon := strings.Index(scp, ":")
+	if at <= 0 || colon < at {
+		return "", "", errors.Errorf("invalid repository url: %s, expected ssh://user@host/path", sshURL)
+	}
+	return scp, scp[:at], nil
+}
+
+// providerFromURL infers the git provider from well known hostnames, defaulting to a plain git host
+func providerFromURL(repositoryURL string) string {
+	u, err := neturl.Parse(repositoryURL)
+	if err != nil {
+		return ProviderGit
+	}
+	host := u.Hostname()
+	switch {
+	case host == "github.com" || strings.HasPrefix(host, "github."):
+		return ProviderGithub
+	case host == "gitlab.com" || strings.HasPrefix(host, "gitlab."):
+		return ProviderGitlab
+	case strings.HasPrefix(host, "gitea."):
+		return ProviderGitea
+	case host == "dev.azure.com" || strings.HasSuffix(host, ".visualstudio.com"):
+		return ProviderAzureDevOps
+	}
+	return ProviderGit
+}
@@ -0,0 +1,98 @@
+package connectors
+
+import (
+	"testing"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+func TestParseSSHURL(t *testing.T) {
+	tests := []struct {
+		url      string
+		expected string
+		user     string
+		err      bool
+	}{
+		{url: "ssh://git@github.com/flanksource/git-operator.git", expected: "ssh://git@github.com/flanksource/git-operator.git", user: "git"},
+		{url: "ssh://deploy@git.example.com:2222/org/repo.git", expected: "ssh://deploy@git.example.com:2222/org/repo.git", user: "deploy"},
+		{url: "ssh://git@github.com:flanksource/git-operator.git", expected: "git@github.com:flanksource/git-operator.git", user: "git"},
+		{url: "ssh://github.com/flanksource/git-operator.git", err: true},
+		{url: "ssh://github.com:flanksource/git-operator.git", err: true},
+	}
+	for _, test := range tests {
+		url, user, err := parseSSHURL(test.url)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.url)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.url, err)
+			continue
+		}
+		if url != test.expected || user != test.user {
+			t.Errorf("%s: expected %s %s, got %s %s", test.url, test.expected, test.user, url, user)
+		}
+		endpoint, err := transport.NewEndpoint(url)
+		if err != nil {
+			t.Errorf("%s: %v", test.url, err)
+			continue
+		}
+		if endpoint.Protocol != "ssh" || endpoint.User != test.user {
+			t.Errorf("%s: expected an ssh endpoint for %s, got %s %s", test.url, test.user, endpoint.Protocol, endpoint.User)
+		}
+	}
+}
+
+func TestParseRepositoryURL(t *testing.T) {
+	tests := []struct {
+		url        string
+		server     string
+		repository string
+		err        bool
+	}{
+		{url: "https://github.com/flanksource/git-operator.git", server: "https://github.com", repository: "flanksource/git-operator"},
+		{url: "https://gitlab.example.com/group/subgroup/project", server: "https://gitlab.example.com", repository: "group/subgroup/project"},
+		{url: "http://gitea.example.com:3000/org/repo.git/", server: "http://gitea.example.com:3000", repository: "org/repo"},
+		{url: "https://dev.azure.com/org/project/_git/repo", server: "https://dev.azure.com", repository: "org/project/_git/repo"},
+		{url: "https://git.example.com/repo.git", err: true},
+		{url: "ssh://git@github.com/flanksource/git-operator.git", err: true},
+		{url: "https:///org/repo", err: true},
+	}
+	for _, test := range tests {
+		server, repository, err := parseRepositoryURL(test.url)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.url)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.url, err)
+			continue
+		}
+		if server != test.server || repository != test.repository {
+			t.Errorf("%s: expected %s %s, got %s %s", test.url, test.server, test.repository, server, repository)
+		}
+	}
+}
+
+func TestProviderFromURL(t *testing.T) {
+	tests := map[string]string{
+		"https://github.com/flanksource/git-operator.git": ProviderGithub,
+		"https://github.example.com/org/repo":             ProviderGithub,
+		"https://gitlab.com/group/project":                ProviderGitlab,
+		"https://gitlab.example.com:8443/group/project":   ProviderGitlab,
+		"https://gitea.example.com/org/repo":              ProviderGitea,
+		"https://dev.azure.com/org/project/_git/repo":     ProviderAzureDevOps,
+		"https://org.visualstudio.com/project/_git/repo":  ProviderAzureDevOps,
+		"https://bitbucket.example.com/scm/PROJ/repo.git": ProviderGit,
+		"https://git.example.com/repo.git":                ProviderGit,
+	}
+	for url, expected := range tests {
+		if provider := providerFromURL(url); provider != expected {
+			t.Errorf("%s: expected %s, got %s", url, expected, provider)
+		}
+	}
+}
@@ -0,0 +1,297 @@
+package connectors
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/osfs"
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp/capability"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+)
+
+// CloneDepth limits clones and fetches of the repository cache to this many commits of history, 0 fetches
+// the full history. The whole tree is always checked out, as go-git does not support sparse checkouts.
+var CloneDepth int
+
+// capabilitiesLock guards the process-wide transport.UnsupportedCapabilities, which go-git reads when
+// fetching. Clones that enable multi_ack hold it exclusively, all other clones share it.
+var capabilitiesLock sync.RWMutex
+
+// gitRepository implements the Clone, Push, DeleteBranch and Close methods of Connector using plain git
+type gitRepository struct {
+	logr.Logger
+	url  string
+	auth transport.AuthMethod
+	// multiAck enables the multi_ack capability while cloning, go-git only supports it for full clones
+	// so the repository cache and shallow clones are not used
+	multiAck bool
+	// pullRequestClosed reports whether the pull request from head into base was closed or merged and
+	// none is open, it is nil for providers without pull requests
+	pullRequestClosed func(ctx context.Context, base, head string) (bool, error)
+	repo              *git.Repository
+	// release releases the checkout returned by Clone, either unlocking the cached repository
+	// or removing the temporary clone
+	release func()
+}
+
+func (g *gitRepository) Clone(ctx context.Context, branch, local string) (billy.Filesystem, *git.Worktree, error) {
+	if err := g.Close(); err != nil {
+		return nil, nil, err
+	}
+	if g.multiAck {
+		capabilitiesLock.Lock()
+		defer capabilitiesLock.Unlock()
+		defaults := transport.UnsupportedCapabilities
+		transport.UnsupportedCapabilities = []capability.Capability{capability.ThinPack}
+		defer func() { transport.UnsupportedCapabilities = defaults }()
+	} else {
+		capabilitiesLock.RLock()
+		defer capabilitiesLock.RUnlock()
+	}
+	if CacheDir != "" && !g.multiAck {
+		fs, repo, work, release, err := checkoutCached(ctx, g.Logger, g.url, g.auth, branch, local)
+		if err != nil {
+			return nil, nil, err
+		}
+		g.repo, g.release = repo, release
+		return fs, work, nil
+	}
+	depth := CloneDepth
+	if g.multiAck {
+		depth = 0
+	}
+	fs, repo, work, err := cloneBranch(ctx, g.Logger, g.url, g.auth, branch, local, depth)
+	if err != nil {
+		return nil, nil, err
+	}
+	g.repo = repo
+	g.release = func() {
+		if err := os.RemoveAll(fs.Root()); err != nil {
+			g.Error(err, "failed to remove clone", "dir", fs.Root())
+		}
+	}
+	return fs, work, nil
+}
+
+// WorkBranch returns the branch to commit to for a pull request from head into base. Commits are appended
+// to head unless it has a closed or merged pull request and none is open, in which case the first of
+// head-2, head-3, ... that does not is used instead, so that the commits of closed pull requests are kept.
+func (g *gitRepository) WorkBranch(ctx context.Context, base, head string) (string, error) {
+	if g.pullRequestClosed == nil {
+		return head, nil
+	}
+	remote := git.NewRemote(memory.NewStorage(), &config.RemoteConfig{
+		Name: git.DefaultRemoteName,
+		URLs: []string{g.url},
+	})
+	refs, err := remote.List(&git.ListOptions{Auth: g.auth})
+	if err != nil {
+		return "", errors.Wrap(err, "failed to list remote branches")
+	}
+	branches := map[string]bool{}
+	for _, ref := range refs {
+		if ref.Name().IsBranch() {
+			branches[ref.Name().Short()] = true
+		}
+	}
+	// branches that do not exist yet have no commits to keep, whatever happened to their pull requests
+	branch := head
+	for i := 2; branches[branch]; i++ {
+		closed, err := g.pullRequestClosed(ctx, base, branch)
+		if err != nil {
+			return "", err
+		}
+		if !closed {
+			break
+		}
+		g.Info("Pull request was closed, committing to a new branch", "closed", branch)
+		branch = fmt.Sprintf("%s-%d", head, i)
+	}
+	return branch, nil
+}
+
+// Close releases the checkout returned by Clone, it must be called once the checkout is no longer used
+func (g *gitRepository) Close() error {
+	if g.release != nil {
+		g.release()
+	}
+	g.repo, g.release = nil, nil
+	return nil
+}
+
+func (g *gitRepository) Push(ctx context.Context, branch string) error {
+	if g.repo == nil {
+		return errors.New("Need to clone first, before pushing ")
+	}
+	return pushBranch(ctx, g.Logger, g.repo, g.auth, branch)
+}
+
+func (g *gitRepository) Ahead(base string) (bool, error) {
+	if g.repo == nil {
+		return false, errors.New("Need to clone first, before comparing branches")
+	}
+	head, err := g.repo.Head()
+	if err != nil {
+		return false, errors.Wrap(err, "failed to get HEAD")
+	}
+	ref, err := g.repo.Reference(plumbing.NewRemoteReferenceName(git.DefaultRemoteName, base), true)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to find branch %s", base)
+	}
+	if head.Hash() == ref.Hash() {
+		return false, nil
+	}
+	headCommit, err := g.repo.CommitObject(head.Hash())
+	if err != nil {
+		return false, err
+	}
+	baseCommit, err := g.repo.CommitObject(ref.Hash())
+	if err != nil {
+		return false, err
+	}
+	merged, err := headCommit.IsAncestor(baseCommit)
+	if err != nil {
+		// the history of shallow clones may not reach back to head
+		g.V(1).Info("Failed to compare branches, assuming changes", "base", base, "error", err.Error())
+		return true, nil
+	}
+	return !merged, nil
+}
+
+// DeleteBranch deletes branch from origin if it exists, without cloning the repository
+func (g *gitRepository) DeleteBranch(ctx context.Context, branch string) error {
+	remote := git.NewRemote(memory.NewStorage(), &config.RemoteConfig{
+		Name: git.DefaultRemoteName,
+		URLs: []string{g.url},
+	})
+	refSpec := config.RefSpec(":" + plumbing.NewBranchReferenceName(branch))
+	err := remote.PushContext(ctx, &git.PushOptions{
+		RefSpecs: []config.RefSpec{refSpec},
+		Auth:     g.auth,
+	})
+	if err == git.NoErrAlreadyUpToDate {
+		g.Info("Branch already deleted", "branch", branch)
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to delete branch %s", branch)
+	}
+	g.Info("Deleted branch", "branch", branch)
+	return nil
+}
+
+// cloneBranch clones the branch of url into a new temporary directory and checks out local
+// using resetBranch. If depth is not 0 only that many commits of history are cloned.
+func cloneBranch(ctx context.Context, log logr.Logger, url string, auth transport.AuthMethod, branch, local string, depth int) (billy.Filesystem, *git.Repository, *git.Worktree, error) {
+	dir, err := ioutil.TempDir("", "git-*")
+	if err != nil {
+		return nil, nil, nil, errors.Wrap(err, "failed to create temp dir")
+	}
+	log.Info("Cloning", "branch", branch, "temp", dir, "depth", depth)
+	repo, err := git.PlainCloneContext(ctx, dir, false, &git.CloneOptions{
+		ReferenceName: plumbing.NewBranchReferenceName(branch),
+		Depth:         depth,
+		URL:           url,
+		Progress:      os.Stdout,
+		Auth:          auth,
+	})
+	if err != nil {
+		os.RemoveAll(dir) // nolint: errcheck
+		return nil, nil, nil, errors.Wrapf(err, "failed to clone %s", branch)
+	}
+
+	work, err := resetBranch(log, repo, branch, local)
+	if err != nil {
+		os.RemoveAll(dir) // nolint: errcheck
+		return nil, nil, nil, err
+	}
+	return osfs.New(dir), repo, work, nil
+}
+
+// resetBranch checks out local, discarding any changes in the worktree. If local differs from branch
+// it is reset to the remote branch of the same name if one exists, so that new commits are appended
+// to it, or to branch otherwise.
+func resetBranch(log logr.Logger, repo *git.Repository, branch, local string) (*git.Worktree, error) {
+	start, err := repo.Reference(plumbing.NewRemoteReferenceName(git.DefaultRemoteName, branch), true)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to find branch %s", branch)
+	}
+	if branch != local {
+		if remote, err := repo.Reference(plumbing.NewRemoteReferenceName(git.DefaultRemoteName, local), true); err == nil {
+			log.Info("Checking out existing branch", "branch", local)
+			start = remote
+		}
+	}
+	ref := plumbing.NewHashReference(plumbing.NewBranchReferenceName(local), start.Hash())
+	if err := repo.Storer.SetReference(ref); err != nil {
+		return nil, errors.Wrapf(err, "failed to create branch %s", local)
+	}
+	work, err := repo.Worktree()
+	if err != nil {
+		return nil, err
+	}
+	if err := work.Checkout(&git.CheckoutOptions{Branch: ref.Name(), Force: true}); err != nil {
+		return nil, errors.Wrapf(err, "failed to checkout %s", local)
+	}
+	if err := work.Reset(&git.ResetOptions{Mode: git.HardReset, Commit: ref.Hash()}); err != nil {
+		return nil, errors.Wrapf(err, "failed to reset %s", local)
+	}
+	if err := work.Clean(&git.CleanOptions{Dir: true}); err != nil {
+		return nil, errors.Wrap(err, "failed to clean worktree")
+	}
+	return work, nil
+}
+
+// pushBranch pushes a local branch to the branch of the same name on origin.
+// branch can either be a plain branch name or a "head:base" pair as passed by the
+// GitopsAPI server, in which case the head branch is pushed and base is only
+// relevant as the target of a pull request.
+func pushBranch(ctx context.Context, log logr.Logger, repo *git.Repository, auth transport.AuthMethod, branch string) error {
+	head := strings.Split(branch, ":")[0]
+	if head == "" {
+		ref, err := repo.Head()
+		if err != nil {
+			return errors.Wrap(err, "failed to get HEAD")
+		}
+		if !ref.Name().IsBranch() {
+			return errors.Errorf("HEAD is not a branch: %s", ref.Name())
+		}
+		head = ref.Name().Short()
+	}
+
+	local := plumbing.NewBranchReferenceName(head)
+	if _, err := repo.Reference(local, true); err != nil {
+		return errors.Wrapf(err, "failed to find local branch %s", head)
+	}
+
+	refSpec := config.RefSpec(fmt.Sprintf("%s:%s", local, local))
+	log.V(1).Info("Pushing", "refspec", refSpec)
+	err := repo.PushContext(ctx, &git.PushOptions{
+		RefSpecs: []config.RefSpec{refSpec},
+		Auth:     auth,
+		Progress: os.Stdout,
+	})
+	if err == git.NoErrAlreadyUpToDate {
+		log.Info("Branch already up to date", "branch", head)
+		return nil
+	}
+	if err != nil && (strings.Contains(err.Error(), "non-fast-forward") || strings.Contains(err.Error(), "fetch first")) {
+		return errors.Wrapf(ErrNonFastForward, "failed to push %s", refSpec)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to push %s", refSpec)
+	}
+	log.Info("Pushed", "branch", head)
+	return nil
+}
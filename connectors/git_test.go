@@ -0,0 +1,174 @@
+package connectors
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-billy/v5/util"
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/pkg/errors"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+func TestCloneRestoresCapabilities(t *testing.T) {
+	defaults := append(transport.UnsupportedCapabilities[:0:0], transport.UnsupportedCapabilities...)
+	repo := &gitRepository{Logger: logf.Log, url: filepath.Join(t.TempDir(), "missing.git"), multiAck: true}
+	if _, _, err := repo.Clone(context.Background(), "master", "master"); err == nil {
+		t.Fatal("expected cloning a missing repository to fail")
+	}
+	if !reflect.DeepEqual(transport.UnsupportedCapabilities, defaults) {
+		t.Errorf("expected the unsupported capabilities to be restored to %v, got %v", defaults, transport.UnsupportedCapabilities)
+	}
+}
+
+// newRemote creates a bare repository with a master branch and a feature branch one commit ahead of it
+func newRemote(t *testing.T) string {
+	dir := filepath.Join(t.TempDir(), "remote.git")
+	if _, err := git.PlainInit(dir, true); err != nil {
+		t.Fatal(err)
+	}
+	work := t.TempDir()
+	repo, err := git.PlainInit(work, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.CreateRemote(&config.RemoteConfig{Name: git.DefaultRemoteName, URLs: []string{dir}}); err != nil {
+		t.Fatal(err)
+	}
+	commitFile(t, repo, "README.md")
+	feature := plumbing.NewBranchReferenceName("feature")
+	tree, _ := repo.Worktree()
+	if err := tree.Checkout(&git.CheckoutOptions{Branch: feature, Create: true}); err != nil {
+		t.Fatal(err)
+	}
+	commitFile(t, repo, "feature.yaml")
+	if err := repo.Push(&git.PushOptions{RefSpecs: []config.RefSpec{"refs/heads/*:refs/heads/*"}}); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func commitFile(t *testing.T, repo *git.Repository, name string) plumbing.Hash {
+	tree, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := util.WriteFile(tree.Filesystem, name, []byte(name), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tree.Add(name); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := tree.Commit("add "+name, &git.CommitOptions{Author: &object.Signature{Name: "test", When: time.Now()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+func remoteBranch(t *testing.T, url, branch string) plumbing.Hash {
+	repo, err := git.PlainOpen(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := repo.Reference(plumbing.NewBranchReferenceName(branch), true)
+	if err != nil {
+		t.Fatalf("branch %s: %v", branch, err)
+	}
+	return ref.Hash()
+}
+
+func TestWorkBranch(t *testing.T) {
+	url := newRemote(t)
+	tests := []struct {
+		name   string
+		head   string
+		closed map[string]bool
+		branch string
+	}{
+		{name: "open pull request", head: "feature", branch: "feature"},
+		{name: "closed pull request", head: "feature", closed: map[string]bool{"feature": true}, branch: "feature-2"},
+		// feature-2 does not exist yet, so its pull requests are not looked up
+		{name: "new branch", head: "feature-2", closed: map[string]bool{"feature-2": true}, branch: "feature-2"},
+	}
+	for _, test := range tests {
+		repo := &gitRepository{Logger: logf.Log, url: url}
+		repo.pullRequestClosed = func(ctx context.Context, base, head string) (bool, error) {
+			return test.closed[head], nil
+		}
+		branch, err := repo.WorkBranch(context.Background(), "master", test.head)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if branch != test.branch {
+			t.Errorf("%s: expected %s, got %s", test.name, test.branch, branch)
+		}
+	}
+}
+
+func TestPushAppendsToBranch(t *testing.T) {
+	url := newRemote(t)
+	feature := remoteBranch(t, url, "feature")
+
+	// a branch whose pull request was closed is kept, the new commit goes to a suffixed branch
+	repo := &gitRepository{Logger: logf.Log, url: url}
+	repo.pullRequestClosed = func(ctx context.Context, base, head string) (bool, error) {
+		return head == "feature", nil
+	}
+	branch, err := repo.WorkBranch(context.Background(), "master", "feature")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := repo.Clone(context.Background(), "master", branch); err != nil {
+		t.Fatal(err)
+	}
+	commitFile(t, repo.repo, "closed.yaml")
+	if err := repo.Push(context.Background(), branch+":master"); err != nil {
+		t.Fatal(err)
+	}
+	repo.Close() // nolint: errcheck
+	if remoteBranch(t, url, "feature") != feature {
+		t.Error("expected the branch of the closed pull request to be kept")
+	}
+	remoteBranch(t, url, "feature-2")
+
+	// without a pull request, commits are appended to the existing branch
+	repo = &gitRepository{Logger: logf.Log, url: url}
+	if _, _, err := repo.Clone(context.Background(), "master", "feature"); err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close() // nolint: errcheck
+	head := commitFile(t, repo.repo, "appended.yaml")
+	commit, err := repo.repo.CommitObject(head)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(commit.ParentHashes) != 1 || commit.ParentHashes[0] != feature {
+		t.Fatalf("expected the commit to be appended to %s, got parents %v", feature, commit.ParentHashes)
+	}
+
+	// the branch moved since it was cloned, the push is rejected rather than forced
+	other := &gitRepository{Logger: logf.Log, url: url}
+	if _, _, err := other.Clone(context.Background(), "master", "feature"); err != nil {
+		t.Fatal(err)
+	}
+	moved := commitFile(t, other.repo, "other.yaml")
+	if err := other.Push(context.Background(), "feature:master"); err != nil {
+		t.Fatal(err)
+	}
+	other.Close() // nolint: errcheck
+	if err := repo.Push(context.Background(), "feature:master"); !errors.Is(err, ErrNonFastForward) {
+		t.Errorf("expected %v, got %v", ErrNonFastForward, err)
+	}
+	if remoteBranch(t, url, "feature") != moved {
+		t.Error("expected the remote branch to be kept")
+	}
+}
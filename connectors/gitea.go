@@ -0,0 +1,49 @@
+package connectors
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-logr/logr"
+	"github.com/jenkins-x/go-scm/scm"
+	"github.com/jenkins-x/go-scm/scm/factory"
+	"github.com/pkg/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+type Gitea struct {
+	*scmConnector
+}
+
+// NewGitea creates a connector for a repository on a Gitea server, server is the base URL of the
+// instance e.g. https://gitea.example.com and repository is owner/name
+func NewGitea(client client.Client, log logr.Logger, server, repository, giteaToken string) (Connector, error) {
+	scmClient, err := factory.NewClient("gitea", server, giteaToken)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create gitea client")
+	}
+
+	cloneURL := fmt.Sprintf("%s/%s.git", server, repository)
+	// gitea accepts an access token as the username when the password is empty or x-oauth-basic
+	auth := &http.BasicAuth{Username: giteaToken, Password: "x-oauth-basic"}
+	gitea := &Gitea{
+		scmConnector: newSCMConnector(client, log.WithName("Gitea").WithName(repository), scmClient, cloneURL, repository, auth),
+	}
+	gitea.requestReview = gitea.requestReviewers
+	// gitea only lists open pull requests unless the state is closed, which includes merged pull requests
+	gitea.findClosedPullRequest = func(ctx context.Context, base, head string) (*scm.PullRequest, error) {
+		return gitea.listPullRequests(ctx, base, head, scm.PullRequestListOptions{Closed: true})
+	}
+	gitea.mergedAt = func(ctx context.Context, number int) (*time.Time, error) {
+		return gitea.getMergedAt(ctx, fmt.Sprintf("api/v1/repos/%s/pulls/%d", repository, number))
+	}
+	return gitea, nil
+}
+
+// requestReviewers requests reviews on a pull request, go-scm maps reviewers onto assignees for Gitea
+func (g *Gitea) requestReviewers(ctx context.Context, repo string, number int, logins []string) (*scm.Response, error) {
+	path := fmt.Sprintf("api/v1/repos/%s/pulls/%d/requested_reviewers", repo, number)
+	return nil, g.do(ctx, "POST", path, map[string][]string{"reviewers": logins}, nil)
+}
@@ -0,0 +1,41 @@
+package connectors
+
+import (
+	"context"
+
+	gitv1 "github.com/flanksource/git-operator/api/v1"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-logr/logr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// GitHTTP is a plain git connector over HTTP(S) for hosts without a supported pull request API
+type GitHTTP struct {
+	gitRepository
+	k8sCrd client.Client
+}
+
+// NewGitHTTP creates a connector for a plain git repository over HTTP(S), auth is either basic or token auth
+func NewGitHTTP(client client.Client, log logr.Logger, url string, auth transport.AuthMethod) (Connector, error) {
+	gitHTTP := &GitHTTP{
+		gitRepository: gitRepository{
+			Logger: log.WithName("connector").WithName("GitHTTP"),
+			url:    url,
+			auth:   auth,
+		},
+		k8sCrd: client,
+	}
+	return gitHTTP, nil
+}
+
+func (g *GitHTTP) OpenPullRequest(ctx context.Context, base string, head string, spec *gitv1.PullRequestTemplate) (int, error) {
+	return 0, ErrPullRequestsUnsupported
+}
+
+func (g *GitHTTP) ClosePullRequest(ctx context.Context, id int) error {
+	return ErrPullRequestsUnsupported
+}
+
+func (g *GitHTTP) GetPullRequest(ctx context.Context, id int) (*gitv1.PullRequestStatus, error) {
+	return nil, ErrPullRequestsUnsupported
+}
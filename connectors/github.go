@@ -3,14 +3,10 @@ package connectors
 import (
 	"context"
 	"fmt"
-	"io/ioutil"
-	"os"
+	nethttp "net/http"
+	"strings"
+	"time"
 
-	gitv1 "github.com/flanksource/git-operator/api/v1"
-	"github.com/go-git/go-billy/v5"
-	"github.com/go-git/go-billy/v5/osfs"
-	git "github.com/go-git/go-git/v5"
-	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/go-git/go-git/v5/plumbing/transport"
 	"github.com/go-git/go-git/v5/plumbing/transport/http"
 	"github.com/go-logr/logr"
@@ -21,119 +17,125 @@ import (
 )
 
 type Github struct {
-	k8sCrd client.Client
-	logr.Logger
-	scm        *scm.Client
-	repo       *git.Repository
-	auth       transport.AuthMethod
-	owner      string
-	repoName   string
-	repository string
+	*scmConnector
+	owner    string
+	repoName string
 }
 
-func NewGithub(client client.Client, log logr.Logger, owner, repoName, githubToken string) (Connector, error) {
-	scmClient, err := factory.NewClient("github", "", githubToken)
+// NewGithub creates a connector for a repository on github.com or a GitHub Enterprise Server, server is the
+// base URL of the instance e.g. https://github.example.com and apiURL optionally overrides the API endpoint
+func NewGithub(client client.Client, log logr.Logger, server, apiURL, owner, repoName, githubToken string) (Connector, error) {
+	if apiURL == "" {
+		// go-scm maps github.com onto https://api.github.com and appends /api/v3 for enterprise servers
+		apiURL = server
+	}
+	scmClient, err := factory.NewClient("github", apiURL, githubToken)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to create github client")
 	}
 
-	github := &Github{
-		k8sCrd:     client,
-		Logger:     log.WithName("Github").WithName(owner + "/" + repoName),
-		scm:        scmClient,
-		owner:      owner,
-		repoName:   repoName,
-		repository: owner + "/" + repoName,
-		auth:       &http.BasicAuth{Password: githubToken, Username: githubToken},
-	}
-	return github, nil
+	auth := &http.BasicAuth{Password: githubToken, Username: githubToken}
+	return newGithub(client, log, server, owner, repoName, scmClient, auth), nil
 }
 
-func (g *Github) Push(ctx context.Context, branch string) error {
-	if g.repo == nil {
-		return errors.New("Need to clone first, before pushing ")
+// NewGithubApp creates a GitHub connector that authenticates as an installation of a GitHub App,
+// installation tokens are minted using the app's private key and refreshed before they expire
+func NewGithubApp(client client.Client, log logr.Logger, server, apiURL, owner, repoName string, appID, installationID int64, privateKey []byte) (Connector, error) {
+	source, err := getGithubAppTokenSource(githubAPIURL(server, apiURL), appID, installationID, privateKey)
+	if err != nil {
+		return nil, err
 	}
-
-	g.V(1).Info("Pushing", "branch", branch)
-
-	if err := g.repo.Push(&git.PushOptions{
-		Auth:     g.auth,
-		Progress: os.Stdout,
-	}); err != nil {
-		return err
+	// mint the token up front, git operations cannot return errors from SetAuth and would only fail authentication
+	if _, err := source.Token(); err != nil {
+		return nil, err
 	}
-	ref, _ := g.repo.Head()
-	g.Info("Pushed", "branch", branch, "ref", ref.String())
-	return nil
-}
-
-func (g *Github) OpenPullRequest(ctx context.Context, base string, head string, spec *gitv1.PullRequestTemplate) (int, error) {
-	if spec.Title == "" {
-		spec.Title = head
+	if apiURL == "" {
+		apiURL = server
 	}
-	g.V(1).Info("Creating PR", "title", spec.Title, "head", head, "base", base)
-	pr, _, err := g.scm.PullRequests.Create(ctx, g.repository, &scm.PullRequestInput{
-		Title: spec.Title,
-		Body:  spec.Body,
-		Head:  head,
-		Base:  base,
-	})
-
+	scmClient, err := factory.NewClient("github", apiURL, "")
 	if err != nil {
-		return 0, errors.Wrapf(err, "failed to create pr repo=%s title=%s, head=%s base=%s", g.repository, spec.Title, head, base)
-	}
-	g.Info("PR created", "pr", pr.Number, "repository", g.repository)
-
-	if len(spec.Reviewers) > 0 {
-		g.Info("Requesting Reviews", "pr", pr.Number, "repository", g.repository, "reviewers", spec.Reviewers)
-		if _, err := g.scm.PullRequests.RequestReview(ctx, g.repository, pr.Number, spec.Reviewers); err != nil {
-			return 0, err
-		}
+		return nil, errors.Wrap(err, "failed to create github client")
 	}
-
-	if len(spec.Assignees) > 0 {
-		g.Info("Assigning PR", "pr", pr.Number, "repository", g.repoName, "assignees", spec.Assignees)
-		if _, err := g.scm.PullRequests.AssignIssue(ctx, g.repository, pr.Number, spec.Assignees); err != nil {
-			return 0, err
-		}
+	scmClient.Client = &nethttp.Client{
+		Transport: &githubAppTransport{source: source, base: nethttp.DefaultTransport},
 	}
 
-	return pr.Number, nil
+	auth := &githubAppAuth{source: source}
+	github := newGithub(client, log, server, owner, repoName, scmClient, auth)
+	auth.log = github.Logger
+	return github, nil
 }
 
-func (g *Github) ClosePullRequest(ctx context.Context, id int) error {
-	if _, err := g.scm.PullRequests.Close(ctx, g.repository, id); err != nil {
-		return errors.Wrap(err, "failed to close github pull request")
+func newGithub(client client.Client, log logr.Logger, server, owner, repoName string, scmClient *scm.Client, auth transport.AuthMethod) *Github {
+	url := fmt.Sprintf("%s/%s/%s.git", server, owner, repoName)
+	github := &Github{
+		scmConnector: newSCMConnector(client, log.WithName("Github").WithName(owner+"/"+repoName), scmClient, url, owner+"/"+repoName, auth),
+		owner:        owner,
+		repoName:     repoName,
 	}
+	github.createDraft = github.createDraftPullRequest
+	github.enableAutoMerge = github.enablePullRequestAutoMerge
+	github.mergedAt = func(ctx context.Context, number int) (*time.Time, error) {
+		return github.getMergedAt(ctx, fmt.Sprintf("repos/%s/pulls/%d", github.repository, number))
+	}
+	return github
+}
 
-	return nil
+// createDraftPullRequest opens a draft pull request, which go-scm does not support
+func (g *Github) createDraftPullRequest(ctx context.Context, input *scm.PullRequestInput) (int, error) {
+	pr := struct {
+		Number int `json:"number"`
+	}{}
+	err := g.do(ctx, "POST", fmt.Sprintf("repos/%s/pulls", g.repository), map[string]interface{}{
+		"title": input.Title,
+		"body":  input.Body,
+		"head":  input.Head,
+		"base":  input.Base,
+		"draft": true,
+	}, &pr)
+	return pr.Number, err
 }
 
-func (g *Github) Clone(ctx context.Context, branch, local string) (billy.Filesystem, *git.Worktree, error) {
-	dir, _ := ioutil.TempDir("", "git-*")
-	url := fmt.Sprintf("https://github.com/%s/%s.git", g.owner, g.repoName)
-	g.Info("Cloning", "temp", dir)
-	repo, err := git.PlainCloneContext(ctx, dir, false, &git.CloneOptions{
-		ReferenceName: plumbing.NewBranchReferenceName(branch),
-		URL:           url,
-		Progress:      os.Stdout,
-		Auth:          g.auth,
-	})
-	if err != nil {
-		return nil, nil, err
+// enablePullRequestAutoMerge enables auto merge using the GraphQL API, which is the only API that supports it
+func (g *Github) enablePullRequestAutoMerge(ctx context.Context, number int, method string) error {
+	pr := struct {
+		NodeID string `json:"node_id"`
+	}{}
+	if err := g.do(ctx, "GET", fmt.Sprintf("repos/%s/pulls/%d", g.repository, number), nil, &pr); err != nil {
+		return err
 	}
-	g.repo = repo
-
-	work, err := repo.Worktree()
-	if err != nil {
-		return nil, nil, err
+	query := map[string]interface{}{
+		"query": `mutation($id: ID!, $method: PullRequestMergeMethod!) {
+  enablePullRequestAutoMerge(input: {pullRequestId: $id, mergeMethod: $method}) { clientMutationId }
+}`,
+		"variables": map[string]string{
+			"id":     pr.NodeID,
+			"method": strings.ToUpper(method),
+		},
+	}
+	res := struct {
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}{}
+	// the GraphQL endpoint is a sibling of the REST API i.e. /graphql or /api/graphql for enterprise servers
+	if err := g.do(ctx, "POST", "../graphql", query, &res); err != nil {
+		return err
+	}
+	if len(res.Errors) > 0 {
+		return errors.New(res.Errors[0].Message)
 	}
-	if branch != local {
-		// nolint: errcheck
-		work.Checkout(&git.CheckoutOptions{
-			Branch: plumbing.NewBranchReferenceName(local),
-			Create: true,
-		})
+	return nil
+}
+
+// githubAPIURL returns the REST API endpoint for server, unless overridden by apiURL
+func githubAPIURL(server, apiURL string) string {
+	switch {
+	case apiURL != "":
+		return apiURL
+	case strings.TrimPrefix(strings.TrimPrefix(server, "https://"), "http://") == "github.com":
+		return "https://api.github.com"
+	default:
+		return server + "/api/v3"
 	}
-	return osfs.New(dir), work, nil
 }
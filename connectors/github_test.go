@@ -0,0 +1,41 @@
+package connectors
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	gitv1 "github.com/flanksource/git-operator/api/v1"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+func TestGetPullRequestMergedAt(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// go-scm serves the API of GitHub Enterprise Servers under /api/v3
+		if r.URL.Path != "/api/v3/repos/owner/repo/pulls/1" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"number": 1, "state": "closed", "merged": true, "merged_at": "2021-06-01T10:00:00Z"}`)) // nolint: errcheck
+	}))
+	defer server.Close()
+
+	github, err := NewGithub(nil, logf.Log, server.URL, server.URL, "owner", "repo", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := github.GetPullRequest(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != gitv1.PullRequestStateMerged {
+		t.Errorf("expected state %s, got %s", gitv1.PullRequestStateMerged, status.State)
+	}
+	expected := time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC)
+	if status.MergedAt == nil || !status.MergedAt.Time.Equal(expected) {
+		t.Errorf("expected mergedAt %s, got %v", expected, status.MergedAt)
+	}
+}
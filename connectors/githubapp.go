@@ -0,0 +1,193 @@
+package connectors
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	nethttp "net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+)
+
+// installation tokens are valid for an hour, refresh them well before they expire
+const githubAppTokenRefreshMargin = 5 * time.Minute
+
+var (
+	githubAppTokensLock sync.Mutex
+	// githubAppTokens caches token sources across connectors, keyed by API URL and installation
+	githubAppTokens = map[string]*githubAppTokenSource{}
+)
+
+// githubAppTokenSource mints and caches installation access tokens for a GitHub App installation
+type githubAppTokenSource struct {
+	apiURL         string
+	appID          int64
+	installationID int64
+	privateKey     []byte
+	key            *rsa.PrivateKey
+	http           *nethttp.Client
+
+	lock   sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+// getGithubAppTokenSource returns the cached token source for the installation, creating a new one
+// if none exists or the private key has been rotated
+func getGithubAppTokenSource(apiURL string, appID, installationID int64, privateKey []byte) (*githubAppTokenSource, error) {
+	githubAppTokensLock.Lock()
+	defer githubAppTokensLock.Unlock()
+
+	id := fmt.Sprintf("%s/%d/%d", apiURL, appID, installationID)
+	if source, found := githubAppTokens[id]; found && string(source.privateKey) == string(privateKey) {
+		return source, nil
+	}
+	key, err := parseRSAPrivateKey(privateKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse GITHUB_APP_PRIVATE_KEY")
+	}
+	source := &githubAppTokenSource{
+		apiURL:         strings.TrimSuffix(apiURL, "/"),
+		appID:          appID,
+		installationID: installationID,
+		privateKey:     privateKey,
+		key:            key,
+		http:           &nethttp.Client{Timeout: 30 * time.Second},
+	}
+	githubAppTokens[id] = source
+	return source, nil
+}
+
+// Token returns a valid installation access token, minting a new one if the cached token is about to expire
+func (s *githubAppTokenSource) Token() (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.token != "" && time.Now().Add(githubAppTokenRefreshMargin).Before(s.expiry) {
+		return s.token, nil
+	}
+	jwt, err := s.jwt()
+	if err != nil {
+		return "", err
+	}
+	url := fmt.Sprintf("%s/app/installations/%d/access_tokens", s.apiURL, s.installationID)
+	req, err := nethttp.NewRequest("POST", url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+jwt)
+	req.Header.Set("Accept", "application/vnd.github.v3+json")
+	res, err := s.http.Do(req)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to create installation token for github app %d", s.appID)
+	}
+	defer res.Body.Close() // nolint: errcheck
+	if res.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(res.Body)
+		return "", errors.Errorf("failed to create installation token for github app %d: %d %s", s.appID, res.StatusCode, string(body))
+	}
+	token := struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}{}
+	if err := json.NewDecoder(res.Body).Decode(&token); err != nil {
+		return "", errors.Wrap(err, "failed to decode installation token")
+	}
+	s.token = token.Token
+	s.expiry = token.ExpiresAt
+	return s.token, nil
+}
+
+// jwt returns a JSON Web Token signed by the app's private key, used to authenticate as the app itself
+func (s *githubAppTokenSource) jwt() (string, error) {
+	now := time.Now()
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		// backdate to allow for clock drift
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": s.appID,
+	})
+	if err != nil {
+		return "", err
+	}
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	hash := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", errors.Wrap(err, "failed to sign github app jwt")
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+func parseRSAPrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM encoded key found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("private key is not an RSA key")
+	}
+	return rsaKey, nil
+}
+
+// githubAppAuth authenticates git operations over HTTPS using installation access tokens
+type githubAppAuth struct {
+	log    logr.Logger
+	source *githubAppTokenSource
+}
+
+func (a *githubAppAuth) SetAuth(r *nethttp.Request) {
+	token, err := a.source.Token()
+	if err != nil {
+		a.log.Error(err, "failed to get github app installation token")
+		return
+	}
+	r.SetBasicAuth("x-access-token", token)
+}
+
+func (a *githubAppAuth) Name() string {
+	return "github-app-auth"
+}
+
+func (a *githubAppAuth) String() string {
+	return fmt.Sprintf("%s - app:%d installation:%d", a.Name(), a.source.appID, a.source.installationID)
+}
+
+// githubAppTransport authenticates API requests using installation access tokens
+type githubAppTransport struct {
+	source *githubAppTokenSource
+	base   nethttp.RoundTripper
+}
+
+func (t *githubAppTransport) RoundTrip(r *nethttp.Request) (*nethttp.Response, error) {
+	token, err := t.source.Token()
+	if err != nil {
+		return nil, err
+	}
+	r = r.Clone(r.Context())
+	r.Header.Set("Authorization", "token "+token)
+	return t.base.RoundTrip(r)
+}
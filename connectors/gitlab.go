@@ -0,0 +1,53 @@
+package connectors
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-logr/logr"
+	"github.com/jenkins-x/go-scm/scm"
+	"github.com/jenkins-x/go-scm/scm/factory"
+	"github.com/pkg/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+type Gitlab struct {
+	*scmConnector
+}
+
+// NewGitlab creates a connector for a project on gitlab.com or a self-hosted Gitlab, server is the
+// base URL of the instance e.g. https://gitlab.example.com and repository the full project path
+func NewGitlab(client client.Client, log logr.Logger, server, repository, gitlabToken string) (Connector, error) {
+	scmClient, err := factory.NewClient("gitlab", server, gitlabToken)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create gitlab client")
+	}
+
+	cloneURL := fmt.Sprintf("%s/%s.git", server, repository)
+	auth := &http.BasicAuth{Username: "oauth2", Password: gitlabToken}
+	gitlab := &Gitlab{
+		scmConnector: newSCMConnector(client, log.WithName("Gitlab").WithName(repository), scmClient, cloneURL, repository, auth),
+	}
+	gitlab.requestReview = gitlab.setReviewers
+	gitlab.mergedAt = func(ctx context.Context, number int) (*time.Time, error) {
+		return gitlab.getMergedAt(ctx, fmt.Sprintf("api/v4/projects/%s/merge_requests/%d", url.PathEscape(repository), number))
+	}
+	return gitlab, nil
+}
+
+// setReviewers sets the reviewers of a merge request, go-scm maps reviewers onto assignees for Gitlab
+func (g *Gitlab) setReviewers(ctx context.Context, repo string, number int, logins []string) (*scm.Response, error) {
+	var ids []int
+	for _, login := range logins {
+		user, _, err := g.scm.Users.FindLogin(ctx, login)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to find gitlab user %s", login)
+		}
+		ids = append(ids, user.ID)
+	}
+	path := fmt.Sprintf("api/v4/projects/%s/merge_requests/%d", url.PathEscape(repo), number)
+	return nil, g.do(ctx, "PUT", path, map[string][]int{"reviewer_ids": ids}, nil)
+}
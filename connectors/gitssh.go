@@ -2,76 +2,90 @@ package connectors
 
 import (
 	"context"
-	"fmt"
+	"io/ioutil"
+	"net"
 	"os"
 
 	gitv1 "github.com/flanksource/git-operator/api/v1"
-	"github.com/go-git/go-billy/v5"
-	"github.com/go-git/go-billy/v5/memfs"
-	git "github.com/go-git/go-git/v5"
-	"github.com/go-git/go-git/v5/plumbing/transport"
 	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
-	"github.com/go-git/go-git/v5/storage/memory"
 	"github.com/go-logr/logr"
-	"github.com/jenkins-x/go-scm/scm"
 	"github.com/pkg/errors"
 	ssh2 "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 type GitSSH struct {
-	*scm.Client
+	gitRepository
 	k8sCrd client.Client
-	log    logr.Logger
-	url    string
-	auth   transport.AuthMethod
 }
 
 func (g *GitSSH) OpenPullRequest(ctx context.Context, base string, head string, spec *gitv1.PullRequestTemplate) (int, error) {
-	return 0, fmt.Errorf("open pull request  not implemented for git ssh")
+	return 0, ErrPullRequestsUnsupported
 }
 
 func (g *GitSSH) ClosePullRequest(ctx context.Context, id int) error {
-	return fmt.Errorf("close pull request  not implemented for git ssh")
+	return ErrPullRequestsUnsupported
 }
 
-func (g *GitSSH) Push(ctx context.Context, branch string) error {
-	return fmt.Errorf("push not implemented for git ssh")
+func (g *GitSSH) GetPullRequest(ctx context.Context, id int) (*gitv1.PullRequestStatus, error) {
+	return nil, ErrPullRequestsUnsupported
 }
 
-func (g *GitSSH) Clone(ctx context.Context, branch, local string) (billy.Filesystem, *git.Worktree, error) {
-	// Filesystem abstraction based on memory
-	fs := memfs.New()
-
-	repo, err := git.Clone(memory.NewStorage(), fs, &git.CloneOptions{
-		URL:      g.url,
-		Progress: os.Stdout,
-		Auth:     g.auth,
-	})
+// NewGitSSH creates a connector for a plain git repository over SSH. Host keys are verified against
+// knownHosts, or are not verified at all if knownHosts is empty.
+func NewGitSSH(client client.Client, log logr.Logger, url, user string, privateKey []byte, password string, knownHosts []byte) (Connector, error) {
+	publicKeys, err := ssh.NewPublicKeys(user, privateKey, password)
 	if err != nil {
-		return nil, nil, err
+		return nil, errors.Wrap(err, "failed to create public keys")
 	}
-
-	work, err := repo.Worktree()
-	if err != nil {
-		return nil, nil, err
+	if len(knownHosts) > 0 {
+		publicKeys.HostKeyCallback, err = newHostKeyCallback(knownHosts)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		log.Info("WARNING: SSH host key verification is disabled", "url", url)
+		publicKeys.HostKeyCallback = ssh2.InsecureIgnoreHostKey()
 	}
 
-	return fs, work, nil
+	gitSSH := &GitSSH{
+		gitRepository: gitRepository{
+			Logger: log.WithName("connector").WithName("GitSSH"),
+			url:    url,
+			auth:   publicKeys,
+		},
+		k8sCrd: client,
+	}
+	return gitSSH, nil
 }
 
-func NewGitSSH(client client.Client, log logr.Logger, url, user string, privateKey []byte, password string) (Connector, error) {
-	publicKeys, err := ssh.NewPublicKeys(user, privateKey, password)
+func newHostKeyCallback(knownHosts []byte) (ssh2.HostKeyCallback, error) {
+	file, err := ioutil.TempFile("", "known_hosts-*")
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to create public keys")
+		return nil, errors.Wrap(err, "failed to create known_hosts file")
 	}
-	publicKeys.HostKeyCallback = ssh2.InsecureIgnoreHostKey()
-
-	github := &GitSSH{
-		k8sCrd: client,
-		log:    log.WithName("connector").WithName("GitSSH"),
-		url:    url,
-		auth:   publicKeys,
+	defer os.Remove(file.Name()) // nolint: errcheck
+	if _, err := file.Write(knownHosts); err != nil {
+		return nil, errors.Wrap(err, "failed to write known_hosts file")
+	}
+	if err := file.Close(); err != nil {
+		return nil, errors.Wrap(err, "failed to write known_hosts file")
 	}
-	return github, nil
+	callback, err := knownhosts.New(file.Name())
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse SSH_KNOWN_HOSTS")
+	}
+
+	return func(hostname string, remote net.Addr, key ssh2.PublicKey) error {
+		err := callback(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		if errors.As(err, &keyErr) {
+			if len(keyErr.Want) == 0 {
+				return errors.Wrapf(ErrSSHHostKeyUnknown, "%s %s", hostname, ssh2.FingerprintSHA256(key))
+			}
+			return errors.Wrapf(ErrSSHHostKeyMismatch, "%s %s", hostname, ssh2.FingerprintSHA256(key))
+		}
+		return err
+	}, nil
 }
@@ -0,0 +1,46 @@
+package connectors
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"testing"
+
+	"github.com/pkg/errors"
+	ssh2 "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func newHostKey(t *testing.T) ssh2.PublicKey {
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh2.NewPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestHostKeyCallback(t *testing.T) {
+	known, other := newHostKey(t), newHostKey(t)
+	callback, err := newHostKeyCallback([]byte(knownhosts.Line([]string{"github.com"}, known) + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote := &net.TCPAddr{IP: net.IPv4(140, 82, 121, 4), Port: 22}
+
+	if err := callback("github.com:22", remote, known); err != nil {
+		t.Errorf("expected the known host key to be accepted, got %v", err)
+	}
+	if err := callback("github.com:22", remote, other); !errors.Is(err, ErrSSHHostKeyMismatch) {
+		t.Errorf("expected %v, got %v", ErrSSHHostKeyMismatch, err)
+	}
+	if err := callback("gitlab.com:22", remote, known); !errors.Is(err, ErrSSHHostKeyUnknown) {
+		t.Errorf("expected %v, got %v", ErrSSHHostKeyUnknown, err)
+	}
+	if _, err := newHostKeyCallback([]byte("github.com not-a-key\n")); err == nil {
+		t.Error("expected invalid known hosts to be rejected")
+	}
+}
@@ -0,0 +1,286 @@
+package connectors
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"time"
+
+	gitv1 "github.com/flanksource/git-operator/api/v1"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-logr/logr"
+	"github.com/jenkins-x/go-scm/scm"
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// scmConnector implements Connector for any provider supported by go-scm, cloning and pushing over HTTPS
+type scmConnector struct {
+	gitRepository
+	k8sCrd     client.Client
+	scm        *scm.Client
+	repository string
+	// requestReview defaults to scm.PullRequests.RequestReview and can be overridden by providers
+	// where go-scm does not map reviewers onto the provider's own concept of reviewers
+	requestReview func(ctx context.Context, repo string, number int, logins []string) (*scm.Response, error)
+	// addLabel defaults to scm.PullRequests.AddLabel which creates missing labels, it is nil for
+	// providers that do not support labels on pull requests
+	addLabel func(ctx context.Context, repo string, number int, label string) (*scm.Response, error)
+	// createDraft and enableAutoMerge are only set by providers that support draft pull requests
+	// and merging pull requests automatically once required reviews and checks pass
+	createDraft     func(ctx context.Context, input *scm.PullRequestInput) (int, error)
+	enableAutoMerge func(ctx context.Context, number int, method string) error
+	// findPullRequest and findClosedPullRequest default to listPullRequests and can be overridden by
+	// providers where go-scm cannot list pull requests reliably. findClosedPullRequest is only called
+	// when no pull request is open and may return open pull requests too.
+	findPullRequest       func(ctx context.Context, base, head string) (*scm.PullRequest, error)
+	findClosedPullRequest func(ctx context.Context, base, head string) (*scm.PullRequest, error)
+	// mergedAt is set by providers that report when a pull request was merged, which go-scm does not expose
+	mergedAt func(ctx context.Context, number int) (*time.Time, error)
+}
+
+func newSCMConnector(client client.Client, log logr.Logger, scmClient *scm.Client, url, repository string, auth transport.AuthMethod) *scmConnector {
+	connector := &scmConnector{
+		gitRepository: gitRepository{
+			Logger: log,
+			url:    url,
+			auth:   auth,
+		},
+		k8sCrd:        client,
+		scm:           scmClient,
+		repository:    repository,
+		requestReview: scmClient.PullRequests.RequestReview,
+		addLabel:      scmClient.PullRequests.AddLabel,
+	}
+	connector.findPullRequest = func(ctx context.Context, base, head string) (*scm.PullRequest, error) {
+		return connector.listPullRequests(ctx, base, head, scm.PullRequestListOptions{Open: true})
+	}
+	connector.findClosedPullRequest = func(ctx context.Context, base, head string) (*scm.PullRequest, error) {
+		return connector.listPullRequests(ctx, base, head, scm.PullRequestListOptions{Open: true, Closed: true})
+	}
+	connector.pullRequestClosed = func(ctx context.Context, base, head string) (bool, error) {
+		if pr, err := connector.findPullRequest(ctx, base, head); err != nil || pr != nil {
+			return false, err
+		}
+		pr, err := connector.findClosedPullRequest(ctx, base, head)
+		return pr != nil, err
+	}
+	return connector
+}
+
+func (g *scmConnector) OpenPullRequest(ctx context.Context, base string, head string, spec *gitv1.PullRequestTemplate) (int, error) {
+	if spec.Title == "" {
+		spec.Title = head
+	}
+	existing, err := g.findPullRequest(ctx, base, head)
+	if err != nil {
+		return 0, err
+	}
+	if existing != nil {
+		g.Info("Updating existing PR", "pr", existing.Number, "repository", g.repository)
+		if _, _, err := g.scm.PullRequests.Update(ctx, g.repository, existing.Number, &scm.PullRequestInput{
+			Title: spec.Title,
+			Body:  spec.Body,
+		}); err != nil {
+			return 0, errors.Wrapf(err, "failed to update pr %d", existing.Number)
+		}
+		// reviewers and labels are templated, so each request can add new ones
+		if err := g.reviewAndLabel(ctx, existing.Number, spec); err != nil {
+			return 0, err
+		}
+		return existing.Number, g.autoMerge(ctx, existing.Number, spec)
+	}
+
+	g.V(1).Info("Creating PR", "title", spec.Title, "head", head, "base", base, "draft", spec.Draft)
+	input := &scm.PullRequestInput{
+		Title: spec.Title,
+		Body:  spec.Body,
+		Head:  head,
+		Base:  base,
+	}
+	var number int
+	if spec.Draft && g.createDraft != nil {
+		number, err = g.createDraft(ctx, input)
+	} else {
+		if spec.Draft {
+			g.Info("Draft PRs are not supported, ignoring", "repository", g.repository)
+		}
+		var pr *scm.PullRequest
+		if pr, _, err = g.scm.PullRequests.Create(ctx, g.repository, input); err == nil {
+			number = pr.Number
+		}
+	}
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to create pr repo=%s title=%s, head=%s base=%s", g.repository, spec.Title, head, base)
+	}
+	g.Info("PR created", "pr", number, "repository", g.repository)
+
+	if len(spec.Assignees) > 0 {
+		g.Info("Assigning PR", "pr", number, "repository", g.repository, "assignees", spec.Assignees)
+		if _, err := g.scm.PullRequests.AssignIssue(ctx, g.repository, number, spec.Assignees); err != nil {
+			return 0, err
+		}
+	}
+	if err := g.reviewAndLabel(ctx, number, spec); err != nil {
+		return 0, err
+	}
+
+	return number, g.autoMerge(ctx, number, spec)
+}
+
+// reviewAndLabel requests reviews from the reviewers of spec and adds its labels
+func (g *scmConnector) reviewAndLabel(ctx context.Context, number int, spec *gitv1.PullRequestTemplate) error {
+	if len(spec.Reviewers) > 0 {
+		g.Info("Requesting Reviews", "pr", number, "repository", g.repository, "reviewers", spec.Reviewers)
+		if _, err := g.requestReview(ctx, g.repository, number, spec.Reviewers); err != nil {
+			return err
+		}
+	}
+
+	if len(spec.Tags) > 0 && g.addLabel == nil {
+		g.Info("Labels are not supported, ignoring", "pr", number, "repository", g.repository, "labels", spec.Tags)
+	} else if len(spec.Tags) > 0 {
+		g.Info("Labelling PR", "pr", number, "repository", g.repository, "labels", spec.Tags)
+		for _, label := range spec.Tags {
+			if _, err := g.addLabel(ctx, g.repository, number, label); err != nil {
+				return errors.Wrapf(err, "failed to add label %s", label)
+			}
+		}
+	}
+	return nil
+}
+
+// autoMerge requests the pull request to be merged once required reviews and checks pass
+func (g *scmConnector) autoMerge(ctx context.Context, number int, spec *gitv1.PullRequestTemplate) error {
+	switch {
+	case !spec.AutoMerge:
+		return nil
+	case spec.Draft:
+		g.Info("Draft PRs cannot be auto merged, ignoring", "pr", number, "repository", g.repository)
+		return nil
+	case g.enableAutoMerge == nil:
+		g.Info("Auto merge is not supported, ignoring", "pr", number, "repository", g.repository)
+		return nil
+	}
+	method := spec.MergeMethod
+	if method == "" {
+		method = gitv1.MergeMethodMerge
+	}
+	g.Info("Enabling auto merge", "pr", number, "repository", g.repository, "method", method)
+	if err := g.enableAutoMerge(ctx, number, method); err != nil {
+		return errors.Wrapf(err, "failed to enable auto merge for pr %d", number)
+	}
+	return nil
+}
+
+func (g *scmConnector) ClosePullRequest(ctx context.Context, id int) error {
+	if _, err := g.scm.PullRequests.Close(ctx, g.repository, id); err != nil {
+		return errors.Wrapf(err, "failed to close pull request %d", id)
+	}
+
+	return nil
+}
+
+func (g *scmConnector) GetPullRequest(ctx context.Context, id int) (*gitv1.PullRequestStatus, error) {
+	pr, _, err := g.scm.PullRequests.Find(ctx, g.repository, id)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get pull request %d", id)
+	}
+	status := &gitv1.PullRequestStatus{
+		Number: pr.Number,
+		URL:    pr.Link,
+		Head:   pr.Source,
+		SHA:    pr.Sha,
+		State:  gitv1.PullRequestStateOpen,
+	}
+	switch {
+	case pr.Merged:
+		status.State = gitv1.PullRequestStateMerged
+		if g.mergedAt == nil {
+			break
+		}
+		mergedAt, err := g.mergedAt(ctx, pr.Number)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get the merge time of pull request %d", id)
+		}
+		if mergedAt != nil {
+			status.MergedAt = &metav1.Time{Time: *mergedAt}
+		}
+	case pr.Closed:
+		status.State = gitv1.PullRequestStateClosed
+	}
+	return status, nil
+}
+
+// listPullRequests returns the first pull request from head into base in the states of opts, or nil if
+// there is none
+func (g *scmConnector) listPullRequests(ctx context.Context, base, head string, opts scm.PullRequestListOptions) (*scm.PullRequest, error) {
+	opts.Page, opts.Size = 1, 100
+	seen := map[int]bool{}
+	for {
+		prs, res, err := g.scm.PullRequests.List(ctx, g.repository, opts)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to list pull requests for %s", g.repository)
+		}
+		// stop when a page returns no new pull requests, in case the provider ignores the page
+		progress := false
+		for _, pr := range prs {
+			if seen[pr.Number] {
+				continue
+			}
+			seen[pr.Number], progress = true, true
+			if pr.Source == head && pr.Target == base && (opts.Closed || !pr.Closed && !pr.Merged) {
+				return pr, nil
+			}
+		}
+		if !progress || res == nil || res.Page.Next <= opts.Page {
+			return nil, nil
+		}
+		opts.Page = res.Page.Next
+	}
+}
+
+// do performs a raw JSON API request for endpoints that are not covered by go-scm
+// getMergedAt reads the merged_at field returned by the GitHub, Gitea and Gitlab APIs for a pull request
+func (g *scmConnector) getMergedAt(ctx context.Context, path string) (*time.Time, error) {
+	pr := struct {
+		MergedAt *time.Time `json:"merged_at"`
+	}{}
+	if err := g.do(ctx, "GET", path, nil, &pr); err != nil {
+		return nil, err
+	}
+	return pr.MergedAt, nil
+}
+
+func (g *scmConnector) do(ctx context.Context, method, path string, in, out interface{}) error {
+	req := &scm.Request{
+		Method: method,
+		Path:   path,
+		Header: map[string][]string{
+			"Accept":       {"application/json"},
+			"Content-Type": {"application/json"},
+		},
+	}
+	if in != nil {
+		body, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		req.Body = bytes.NewReader(body)
+	}
+	res, err := g.scm.Do(ctx, req)
+	if err != nil {
+		return errors.Wrapf(err, "%s %s failed", method, path)
+	}
+	defer res.Body.Close() // nolint: errcheck
+	if res.Status >= 300 {
+		body, _ := ioutil.ReadAll(res.Body)
+		return errors.Errorf("%s %s failed with %d: %s", method, path, res.Status, string(body))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
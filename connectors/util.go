@@ -4,7 +4,9 @@ import (
 	"context"
 
 	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
 )
 
@@ -15,6 +17,22 @@ var (
 	ErrProviderNotFoundInSecret = errors.New("PROVIDER field not found in credentials secret")
 	// ErrGithubTokenNotFoundInSecret is returned if GITHUB_TOKEN field is not present in credentials secret
 	ErrGithubTokenNotFoundInSecret = errors.New("GITHUB_TOKEN field not found in credentials secret")
+	// ErrGithubAppPrivateKeyNotFoundInSecret is returned if GITHUB_APP_ID is present but GITHUB_APP_PRIVATE_KEY is not
+	ErrGithubAppPrivateKeyNotFoundInSecret = errors.New("GITHUB_APP_PRIVATE_KEY field not found in credentials secret")
+	// ErrGitlabTokenNotFoundInSecret is returned if GITLAB_TOKEN field is not present in credentials secret
+	ErrGitlabTokenNotFoundInSecret = errors.New("GITLAB_TOKEN field not found in credentials secret")
+	// ErrGiteaTokenNotFoundInSecret is returned if GITEA_TOKEN field is not present in credentials secret
+	ErrGiteaTokenNotFoundInSecret = errors.New("GITEA_TOKEN field not found in credentials secret")
+	// ErrBitbucketTokenNotFoundInSecret is returned if BITBUCKET_TOKEN field is not present in credentials secret
+	ErrBitbucketTokenNotFoundInSecret = errors.New("BITBUCKET_TOKEN field not found in credentials secret")
+	// ErrAzureDevOpsTokenNotFoundInSecret is returned if AZURE_DEVOPS_TOKEN field is not present in credentials secret
+	ErrAzureDevOpsTokenNotFoundInSecret = errors.New("AZURE_DEVOPS_TOKEN field not found in credentials secret")
+	// ErrGitCredentialsNotFoundInSecret is returned if neither GIT_TOKEN nor GIT_PASSWORD are present in credentials secret
+	ErrGitCredentialsNotFoundInSecret = errors.New("GIT_TOKEN or GIT_PASSWORD field not found in credentials secret")
+	// ErrNonFastForward is returned when a push is rejected because the remote branch has commits that were not cloned
+	ErrNonFastForward = errors.New("non-fast-forward update")
+	// ErrPullRequestsUnsupported is returned by connectors for plain git repositories without a pull request API
+	ErrPullRequestsUnsupported = errors.New("pull requests unsupported")
 	// ErrProviderNotSupported is returned when PROVIDER field in credentials secret does not match any known provider
 	ErrProviderNotSupported = errors.New("PROVIDER not supported, valid providers are: github")
 	// ErrSSHUserNotFoundInSecret is returned when SSH_USER is not present in credentials secret
@@ -23,14 +41,25 @@ var (
 	ErrSSHPrivateKeyNotFoundInSecret = errors.New("SSH_PRIVATE_KEY field not found in credentials secret")
 	// ErrGitSSHURLIsEmpty is returned when gitSSH.url is not present
 	ErrGitSSHURLIsEmpty = errors.New("GitSSH url was not provided")
+	// ErrSSHKnownHostsNotFound is returned when no known hosts are available to verify an SSH host key against
+	ErrSSHKnownHostsNotFound = errors.New("SSH_KNOWN_HOSTS field not found in credentials secret or known hosts ConfigMap, set sshInsecureIgnoreHostKey to skip host key verification")
+	// ErrSSHHostKeyUnknown is returned when the SSH host key is not present in the known hosts
+	ErrSSHHostKeyUnknown = errors.New("SSH host key not found in known hosts")
+	// ErrSSHHostKeyMismatch is returned when the SSH host key does not match the key in the known hosts
+	ErrSSHHostKeyMismatch = errors.New("SSH host key does not match known hosts")
 )
 
+// KnownHostsConfigMap is an optional ConfigMap in the operator namespace with a known_hosts key, used to verify
+// SSH host keys when the credentials secret does not contain SSH_KNOWN_HOSTS
+var KnownHostsConfigMap *types.NamespacedName
+
 type RepositoryCredentials struct {
 	Provider  string
 	AuthToken string
 }
 
 // +kubebuilder:rbac:groups="",namespace=system,resources=secrets,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",namespace=system,resources=configmaps,verbs=get
 
 func GetRepositoryCredentials(ctx context.Context, k8s *kubernetes.Clientset, secretName, namespace string) (*RepositoryCredentials, error) {
 	secret, err := k8s.CoreV1().Secrets(namespace).Get(ctx, secretName, metav1.GetOptions{})
@@ -52,3 +81,17 @@ func GetRepositoryCredentials(ctx context.Context, k8s *kubernetes.Clientset, se
 
 	return nil, ErrProviderNotSupported
 }
+
+func getKnownHosts(ctx context.Context, k8s *kubernetes.Clientset, secret *v1.Secret) ([]byte, error) {
+	if knownHosts, found := secret.Data["SSH_KNOWN_HOSTS"]; found {
+		return knownHosts, nil
+	}
+	if KnownHostsConfigMap == nil {
+		return nil, nil
+	}
+	cm, err := k8s.CoreV1().ConfigMaps(KnownHostsConfigMap.Namespace).Get(ctx, KnownHostsConfigMap.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get known hosts configmap %s", KnownHostsConfigMap)
+	}
+	return []byte(cm.Data["known_hosts"]), nil
+}
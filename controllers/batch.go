@@ -0,0 +1,87 @@
+package controllers
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	gitv1 "github.com/flanksource/git-operator/api/v1"
+)
+
+type batch struct {
+	*job
+	timer   *time.Timer
+	objects int
+}
+
+// batcher accumulates requests for the same GitopsAPI and branch, queueing them to be committed together
+// once the batch window ends or the batch is full
+type batcher struct {
+	lock sync.Mutex
+	// batches that are still accepting requests, keyed by GitopsAPI and templated branch
+	open map[string]*batch
+}
+
+// add adds the operations of a request to the open batch for its branch, starting a new batch if there is
+// none, and returns the ID the status of the request can be polled with
+func (b *batcher) add(r *GitopsAPIReconciler, api *gitv1.GitopsAPI, ops ...operation) (string, error) {
+	objs, err := parseOperations(ops)
+	if err != nil {
+		return "", err
+	}
+	target := api.DeepCopy()
+	addDefaults(target)
+	if err := templateBranch(target, objs[0]); err != nil {
+		return "", err
+	}
+	key := fmt.Sprintf("%s/%s/%s", api.Namespace, api.Name, target.Spec.Branch)
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.open == nil {
+		b.open = map[string]*batch{}
+	}
+	current, found := b.open[key]
+	if !found {
+		current = &batch{job: &job{api: api.DeepCopy()}}
+		b.open[key] = current
+		current.timer = time.AfterFunc(api.Spec.Batch.Window.Duration, func() {
+			b.flush(r, key, current)
+		})
+		r.Log.Info("Started batch", "branch", target.Spec.Branch, "window", api.Spec.Batch.Window.Duration)
+	}
+	request := r.jobs.newJob(api, JobStatePending)
+	request.ops = ops
+	current.requests = append(current.requests, request)
+	current.objects += countObjects(objs)
+	for _, j := range current.requests {
+		r.jobs.update(j, func(status *JobStatus) {
+			status.Requests = len(current.requests)
+			status.Objects = current.objects
+		})
+	}
+	if max := api.Spec.Batch.MaxObjects; max > 0 && current.objects >= max {
+		// stop accepting requests straight away, the next request starts a new batch
+		delete(b.open, key)
+		if current.timer.Stop() {
+			go b.flush(r, key, current)
+		}
+	}
+	return request.status.ID, nil
+}
+
+// flush closes the batch and queues it to be committed, waiting for space in the queue if it is full
+func (b *batcher) flush(r *GitopsAPIReconciler, key string, current *batch) {
+	b.lock.Lock()
+	if b.open[key] == current {
+		delete(b.open, key)
+	}
+	b.lock.Unlock()
+
+	for _, request := range current.requests {
+		r.jobs.update(request, func(status *JobStatus) {
+			status.State = JobStateQueued
+		})
+	}
+	r.jobs.queue <- current.job
+}
@@ -0,0 +1,131 @@
+package controllers
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	gitv1 "github.com/flanksource/git-operator/api/v1"
+	"github.com/flanksource/git-operator/connectors"
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/util"
+	gitv5 "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// fakeConnector commits to a local repository that is kept between clones, methods that are not
+// implemented panic
+type fakeConnector struct {
+	connectors.Connector
+	fs   billy.Filesystem
+	repo *gitv5.Repository
+	// the commit of each branch on the remote, which is only updated by successful pushes
+	remote map[string]plumbing.Hash
+	// the heads WorkBranch was called with
+	workBranches []string
+	// the branches pushed and the heads pull requests were opened from
+	pushed       []string
+	pullRequests []string
+	// returned by OpenPullRequest instead of opening a pull request
+	openErr error
+	// returned by the next pushes, in order
+	pushErrs []error
+}
+
+// newFakeConnector returns a connector for a repository with a single commit on master
+func newFakeConnector(t *testing.T) *fakeConnector {
+	repo, err := gitv5.PlainInit(t.TempDir(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	work, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := work.Filesystem
+	if err := util.WriteFile(fs, "README.md", []byte("test"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := work.Add("README.md"); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := work.Commit("initial commit", &gitv5.CommitOptions{Author: &object.Signature{Name: "test", When: time.Now()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &fakeConnector{fs: fs, repo: repo, remote: map[string]plumbing.Hash{"master": hash}}
+}
+
+func (f *fakeConnector) WorkBranch(ctx context.Context, base, head string) (string, error) {
+	f.workBranches = append(f.workBranches, head)
+	return head, nil
+}
+
+// Clone checks out local at its commit on the remote, or at the commit of branch if it was not pushed yet
+func (f *fakeConnector) Clone(ctx context.Context, branch, local string) (billy.Filesystem, *gitv5.Worktree, error) {
+	start, found := f.remote[local]
+	if !found {
+		start = f.remote[branch]
+	}
+	ref := plumbing.NewHashReference(plumbing.NewBranchReferenceName(local), start)
+	if err := f.repo.Storer.SetReference(ref); err != nil {
+		return nil, nil, err
+	}
+	work, err := f.repo.Worktree()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := work.Checkout(&gitv5.CheckoutOptions{Branch: ref.Name(), Force: true}); err != nil {
+		return nil, nil, err
+	}
+	if err := work.Reset(&gitv5.ResetOptions{Mode: gitv5.HardReset, Commit: start}); err != nil {
+		return nil, nil, err
+	}
+	if err := work.Clean(&gitv5.CleanOptions{Dir: true}); err != nil {
+		return nil, nil, err
+	}
+	return f.fs, work, nil
+}
+
+// Push records the branch and pushes the head branch of a head:base pair, unless an error is queued
+func (f *fakeConnector) Push(ctx context.Context, branch string) error {
+	f.pushed = append(f.pushed, branch)
+	if len(f.pushErrs) > 0 {
+		err := f.pushErrs[0]
+		f.pushErrs = f.pushErrs[1:]
+		return err
+	}
+	head := strings.Split(branch, ":")[0]
+	ref, err := f.repo.Reference(plumbing.NewBranchReferenceName(head), true)
+	if err != nil {
+		return err
+	}
+	f.remote[head] = ref.Hash()
+	return nil
+}
+
+func (f *fakeConnector) Ahead(base string) (bool, error) {
+	head, err := f.repo.Head()
+	if err != nil {
+		return false, err
+	}
+	return head.Hash() != f.remote[base], nil
+}
+
+func (f *fakeConnector) OpenPullRequest(ctx context.Context, base string, head string, spec *gitv1.PullRequestTemplate) (int, error) {
+	if f.openErr != nil {
+		return 0, f.openErr
+	}
+	f.pullRequests = append(f.pullRequests, head)
+	return len(f.pullRequests), nil
+}
+
+func (f *fakeConnector) GetPullRequest(ctx context.Context, id int) (*gitv1.PullRequestStatus, error) {
+	return &gitv1.PullRequestStatus{Number: id, Head: f.pullRequests[id-1], State: gitv1.PullRequestStateOpen}, nil
+}
+
+func (f *fakeConnector) Close() error {
+	return nil
+}
@@ -25,11 +25,11 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"regexp"
 	"strings"
 	"time"
 
 	"github.com/gosimple/slug"
-	"github.com/labstack/gommon/random"
 
 	"github.com/flanksource/kommons"
 	"github.com/go-git/go-billy/v5"
@@ -38,9 +38,13 @@ import (
 	"github.com/go-logr/logr"
 	"github.com/imdario/mergo"
 	"github.com/labstack/echo"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/kustomize/api/types"
@@ -58,80 +62,374 @@ type GitopsAPIReconciler struct {
 	Clientset *kubernetes.Clientset
 	Log       logr.Logger
 	Scheme    *runtime.Scheme
+
+	// The number of workers committing asynchronous requests and batches, defaults to 4
+	Workers int
+
+	batches batcher
+	jobs    jobQueue
 }
 
 // +kubebuilder:rbac:groups=git.flanksource.com,resources=gitopsapis,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=git.flanksource.com,resources=gitopsapis/status,verbs=get;update;patch
 
+// pushBackoff retries pushes rejected as non fast forward for up to ~8 seconds
+var pushBackoff = wait.Backoff{
+	Duration: 500 * time.Millisecond,
+	Factor:   2,
+	Jitter:   0.1,
+	Steps:    5,
+}
+
+const (
+	// the number of pull requests recorded in the status of a GitopsAPI, open pull requests are always recorded
+	maxPullRequestStatuses = 10
+	// finalizer closes the pull requests opened by a GitopsAPI when it is deleted
+	finalizer = "git.flanksource.com/pull-requests"
+	// the number of objects listed in a commit title, e.g. when committing a batch
+	maxTitleObjects = 10
+)
+
+// Reconcile refreshes the state of open pull requests recorded in the status, it is called at least
+// once every sync period
 func (r *GitopsAPIReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
-	_ = context.Background()
-	_ = r.Log.WithValues("gitopsapi", req.NamespacedName)
+	ctx := context.Background()
+	log := r.Log.WithValues("gitopsapi", req.NamespacedName)
 
-	return ctrl.Result{}, nil
+	api := gitv1.GitopsAPI{}
+	if err := r.Get(ctx, req.NamespacedName, &api); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	if api.DeletionTimestamp != nil {
+		return ctrl.Result{}, r.finalize(ctx, log, &api)
+	}
+	if findElement(api.Finalizers, finalizer) == -1 {
+		api.Finalizers = append(api.Finalizers, finalizer)
+		return ctrl.Result{}, r.Update(ctx, &api)
+	}
+	if api.Status.OpenPullRequests == 0 {
+		return ctrl.Result{}, nil
+	}
+	git, err := connectors.NewConnector(ctx, r.Client, r.Clientset, log, req.Namespace, &api.Spec)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	var prs []gitv1.PullRequestStatus
+	for _, pr := range api.Status.PullRequests {
+		if pr.State != gitv1.PullRequestStateOpen {
+			continue
+		}
+		status, err := git.GetPullRequest(ctx, pr.Number)
+		if err != nil {
+			log.Error(err, "failed to refresh pull request", "pr", pr.Number)
+			continue
+		}
+		prs = append(prs, *status)
+	}
+	return ctrl.Result{}, r.updatePullRequestStatus(ctx, req.NamespacedName, prs...)
 }
 
-func serve(c echo.Context, r *GitopsAPIReconciler) error {
-	ctx := context.Background()
+// finalize closes the open pull requests of a deleted GitopsAPI and optionally deletes their branches
+func (r *GitopsAPIReconciler) finalize(ctx context.Context, log logr.Logger, api *gitv1.GitopsAPI) error {
+	index := findElement(api.Finalizers, finalizer)
+	if index == -1 {
+		return nil
+	}
+	git, err := connectors.NewConnector(ctx, r.Client, r.Clientset, log, api.Namespace, &api.Spec)
+	if err != nil {
+		// e.g. the credentials were deleted along with the namespace, retrying would block the deletion forever
+		log.Error(err, "failed to create connector, pull requests and branches will not be cleaned up")
+	} else if err := cleanup(ctx, log, git, api); err != nil {
+		return err
+	}
+	api.Finalizers = removeElement(api.Finalizers, index)
+	return r.Update(ctx, api)
+}
+
+func cleanup(ctx context.Context, log logr.Logger, git connectors.Connector, api *gitv1.GitopsAPI) error {
+	branches := map[string]bool{}
+	for _, pr := range api.Status.PullRequests {
+		if pr.Head != "" && pr.Head != api.Spec.Base {
+			branches[pr.Head] = true
+		}
+		if pr.State != gitv1.PullRequestStateOpen {
+			continue
+		}
+		// the pull request may have been merged or closed since the status was last refreshed
+		status, err := git.GetPullRequest(ctx, pr.Number)
+		if err != nil {
+			log.Error(err, "failed to get pull request, skipping", "pr", pr.Number)
+			continue
+		}
+		if status.State != gitv1.PullRequestStateOpen {
+			continue
+		}
+		log.Info("Closing pull request", "pr", pr.Number)
+		if err := git.ClosePullRequest(ctx, pr.Number); err != nil {
+			return err
+		}
+	}
+	if !api.Spec.DeleteBranches {
+		return nil
+	}
+	for branch := range branches {
+		if err := git.DeleteBranch(ctx, branch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// updatePullRequestStatus records pull requests in the status, updating pull requests that are
+// already recorded and adding new ones as the most recent
+func (r *GitopsAPIReconciler) updatePullRequestStatus(ctx context.Context, key client.ObjectKey, prs ...gitv1.PullRequestStatus) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		api := gitv1.GitopsAPI{}
+		if err := r.Get(ctx, key, &api); err != nil {
+			return err
+		}
+		status := api.Status.DeepCopy()
+		for _, pr := range prs {
+			found := false
+			for i := range status.PullRequests {
+				if status.PullRequests[i].Number == pr.Number {
+					status.PullRequests[i] = pr
+					found = true
+				}
+			}
+			if !found {
+				status.PullRequests = append([]gitv1.PullRequestStatus{pr}, status.PullRequests...)
+			}
+		}
+		status.PullRequests = truncatePullRequests(status.PullRequests)
+		status.OpenPullRequests = 0
+		for _, pr := range status.PullRequests {
+			if pr.State == gitv1.PullRequestStateOpen {
+				status.OpenPullRequests++
+			}
+		}
+		if equality.Semantic.DeepEqual(*status, api.Status) {
+			return nil
+		}
+		api.Status = *status
+		return r.Status().Update(ctx, &api)
+	})
+}
+
+// truncatePullRequests keeps every open pull request, which are still refreshed and closed by the finalizer,
+// and the newest merged or closed pull requests up to maxPullRequestStatuses in total
+func truncatePullRequests(prs []gitv1.PullRequestStatus) []gitv1.PullRequestStatus {
+	finished := maxPullRequestStatuses
+	for _, pr := range prs {
+		if pr.State == gitv1.PullRequestStateOpen {
+			finished--
+		}
+	}
+	var truncated []gitv1.PullRequestStatus
+	for _, pr := range prs {
+		if pr.State != gitv1.PullRequestStateOpen {
+			if finished <= 0 {
+				continue
+			}
+			finished--
+		}
+		truncated = append(truncated, pr)
+	}
+	return truncated
+}
+
+// getAPI returns the GitopsAPI addressed by the request, checking the token of GitopsAPIs with a tokenRef
+// which can be passed in the path, as a ?token= argument or in the Authorization header
+func getAPI(ctx context.Context, c echo.Context, r *GitopsAPIReconciler) (*gitv1.GitopsAPI, error) {
 	name := c.Param("name")
 	namespace := c.Param("namespace")
 	token := c.Param("token")
-	deleteObj := strings.HasPrefix(c.Path(), "/_delete")
 	if token == "" {
 		token = c.QueryParam("token")
 	}
 	if token == "" {
 		token = c.Request().Header.Get("Authorization")
 	}
-	contentType := c.Request().Header.Get("Content-Type")
 	api := gitv1.GitopsAPI{}
 	if err := r.Get(ctx, client.ObjectKey{Name: name, Namespace: namespace}, &api); err != nil {
-		return c.String(http.StatusNotFound, "")
+		return nil, echo.NewHTTPError(http.StatusNotFound)
 	}
 
 	if api.Spec.TokenRef != nil {
 		tokenValue, err := r.Clientset.CoreV1().Secrets(namespace).Get(ctx, api.Spec.TokenRef.Name, metav1.GetOptions{})
 		if err != nil {
-			return c.String(http.StatusInternalServerError, err.Error())
+			return nil, echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 		}
 		if token != string(tokenValue.Data["TOKEN"]) {
-			return c.String(http.StatusForbidden, "")
+			return nil, echo.NewHTTPError(http.StatusForbidden)
 		}
 	}
 
 	r.Log.Info("Found API", "name", name, "namespace", namespace, "repo", api.Spec.GitRepository, "secret", *api.Spec.SecretRef, "client", r.Client, "ctx", ctx)
+	return &api, nil
+}
 
-	git, err := connectors.NewConnector(ctx, r.Client, r.Clientset, r.Log, namespace, api.Spec.GitRepository, api.Spec.SecretRef)
+func serve(c echo.Context, r *GitopsAPIReconciler) error {
+	ctx := context.Background()
+	namespace := c.Param("namespace")
+	deleteObj := strings.HasPrefix(c.Path(), "/_delete")
+	contentType := c.Request().Header.Get("Content-Type")
+	found, err := getAPI(ctx, c, r)
 	if err != nil {
-		return c.String(http.StatusInternalServerError, err.Error())
-	}
-	var work *gitv5.Worktree
-	var title, hash string
-	var pr int
-	if deleteObj {
-		work, title, err = DeleteObject(ctx, r.Log, git, &api, c.Request().Body, contentType)
-	} else {
-		work, title, err = CreateOrUpdateObject(ctx, r.Log, git, &api, c.Request().Body, contentType)
+		return err
 	}
+	api := *found
+
+	body, err := ioutil.ReadAll(c.Request().Body)
 	if err != nil {
-		r.Log.Error(err, "error updating files")
-		return c.String(http.StatusInternalServerError, err.Error())
+		return respondError(c, echo.NewHTTPError(http.StatusBadRequest, err.Error()))
 	}
-	hash, err = CreateCommit(&api, work, title)
+	ops := []operation{{delete: deleteObj, body: body, contentType: contentType}}
+	if c.Request().Method == http.MethodPatch {
+		if _, err := patchType(contentType); err != nil {
+			return respondError(c, err)
+		}
+		target := &unstructured.Unstructured{}
+		target.SetKind(c.Param("kind"))
+		target.SetNamespace(c.Param("objNamespace"))
+		target.SetName(c.Param("objName"))
+		ops = []operation{{target: target, body: body, contentType: contentType}}
+	}
+	if strings.HasPrefix(c.Path(), "/_transaction") {
+		if ops, err = parseTransaction(body); err != nil {
+			return respondError(c, err)
+		}
+	}
+	if strings.HasPrefix(c.Path(), "/_plan") || c.QueryParam("dryRun") == "true" {
+		git, err := connectors.NewConnector(ctx, r.Client, r.Clientset, r.Log, namespace, &api.Spec)
+		if err != nil {
+			return respondError(c, err)
+		}
+		defer git.Close() // nolint: errcheck
+		result, err := plan(ctx, r.Log, git, &api, ops...)
+		if err != nil {
+			return respondError(c, err)
+		}
+		return c.JSON(http.StatusOK, result)
+	}
+	if api.Spec.Batch != nil {
+		id, err := r.batches.add(r, &api, ops...)
+		if err != nil {
+			return respondError(c, err)
+		}
+		status, _ := r.jobs.get(id)
+		c.Response().Header().Set(echo.HeaderLocation, "/_pending/"+id)
+		return c.JSON(http.StatusAccepted, status)
+	}
+	if c.QueryParam("async") == "true" {
+		id, err := r.jobs.submit(&api, ops...)
+		if err != nil {
+			return respondError(c, err)
+		}
+		status, _ := r.jobs.get(id)
+		c.Response().Header().Set(echo.HeaderLocation, "/_jobs/"+id)
+		return c.JSON(http.StatusAccepted, status)
+	}
+
+	git, err := connectors.NewConnector(ctx, r.Client, r.Clientset, r.Log, namespace, &api.Spec)
 	if err != nil {
-		r.Log.Error(err, "error creating commit")
-		return c.String(http.StatusInternalServerError, err.Error())
+		return respondError(c, err)
+	}
+	defer git.Close() // nolint: errcheck
+	result, err := r.commit(ctx, git, &api, false, ops...)
+	if err != nil && !errors.Is(err, connectors.ErrPullRequestsUnsupported) {
+		return respondResultError(c, result, err)
 	}
-	if err = git.Push(ctx, fmt.Sprintf("%s:%s", api.Spec.Branch, api.Spec.Base)); err != nil {
-		return c.String(http.StatusInternalServerError, err.Error())
+	if result.Commit == "" {
+		return c.JSON(http.StatusOK, result)
 	}
+	return c.JSON(http.StatusAccepted, result)
+}
 
-	if api.Spec.PullRequest != nil {
-		pr, err = git.OpenPullRequest(ctx, api.Spec.Base, api.Spec.Branch, api.Spec.PullRequest)
+// commit applies ops to the branch of spec in a single commit, pushes it and opens or updates the pull
+// request. Pushes rejected because another replica pushed to the branch since it was cloned are retried,
+// applying the changes again on top of the new commits. Nothing is committed if none of the objects changed,
+// but the pull request is still opened if the branch has commits, e.g. when opening it failed for an earlier
+// request. If the commit was pushed but the pull request could not be opened, the result is returned along
+// with the error, which is ErrPullRequestsUnsupported if the provider does not support pull requests. batched is set when ops were coalesced from several requests by a batch,
+// in which case the pull request is titled after the commit rather than the first object.
+func (r *GitopsAPIReconciler) commit(ctx context.Context, git connectors.Connector, spec *gitv1.GitopsAPI, batched bool, ops ...operation) (*Result, error) {
+	unlock := lockBranch(spec.Spec.GitRepository, spec.Spec.Branch)
+	defer unlock()
+	var api *gitv1.GitopsAPI
+	var result *Result
+	err := retry.OnError(pushBackoff, func(err error) bool {
+		if errors.Is(err, connectors.ErrNonFastForward) {
+			r.Log.Info("Push rejected, retrying", "repo", api.Spec.GitRepository, "branch", api.Spec.Branch)
+			return true
+		}
+		return false
+	}, func() error {
+		api = spec.DeepCopy()
+		work, title, objects, err := applyOperations(ctx, r.Log, git, api, ops...)
+		if err != nil {
+			r.Log.Error(err, "error updating files")
+			return err
+		}
+		result = &Result{Base: api.Spec.Base, Branch: api.Spec.Branch, Objects: objects}
+		status, err := work.Status()
+		if err != nil {
+			return err
+		}
+		if status.IsClean() {
+			return nil
+		}
+		result.Commit, err = CreateCommit(api, work, title)
+		if err != nil {
+			r.Log.Error(err, "error creating commit")
+			return err
+		}
+		// the title templated from the first object does not describe a batch
+		if batched && api.Spec.PullRequest != nil {
+			api.Spec.PullRequest.Title = title
+		}
+		err = git.Push(ctx, fmt.Sprintf("%s:%s", api.Spec.Branch, api.Spec.Base))
+		if err != nil && !errors.Is(err, connectors.ErrNonFastForward) {
+			return hostError(err)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if api.Spec.PullRequest == nil || api.Spec.Branch == api.Spec.Base {
+		return result, nil
+	}
+	if result.Commit == "" {
+		ahead, err := git.Ahead(api.Spec.Base)
 		if err != nil {
-			return c.String(http.StatusInternalServerError, err.Error())
+			return result, err
+		}
+		if !ahead {
+			return result, nil
 		}
 	}
-	return c.String(http.StatusAccepted, fmt.Sprintf("Committed %s, PR: %d ", hash, pr))
+
+	number, err := git.OpenPullRequest(ctx, api.Spec.Base, api.Spec.Branch, api.Spec.PullRequest)
+	if errors.Is(err, connectors.ErrPullRequestsUnsupported) {
+		r.Log.Info("Skipping pull request", "repo", api.Spec.GitRepository, "reason", err.Error())
+		result.PullRequestsUnsupported = true
+		return result, err
+	}
+	if err != nil {
+		return result, hostError(err)
+	}
+	pr, err := git.GetPullRequest(ctx, number)
+	if err != nil {
+		r.Log.Error(err, "failed to get pull request", "pr", number)
+		pr = &gitv1.PullRequestStatus{Number: number, Head: api.Spec.Branch, State: gitv1.PullRequestStateOpen, SHA: result.Commit}
+	}
+	result.PullRequest = pr.Number
+	result.PullRequestURL = pr.URL
+	if err := r.updatePullRequestStatus(ctx, client.ObjectKey{Name: api.Name, Namespace: api.Namespace}, *pr); err != nil {
+		r.Log.Error(err, "failed to update status", "pr", number)
+	}
+	return result, nil
 }
 
 func GetKustomizaton(fs billy.Filesystem, path string) (*types.Kustomization, error) {
@@ -154,166 +452,271 @@ func GetKustomizaton(fs billy.Filesystem, path string) (*types.Kustomization, er
 	return &kustomization, nil
 }
 
+// operation is a create/update or delete request for the objects in body, or a patch of target
+type operation struct {
+	delete      bool
+	body        []byte
+	contentType string
+	// target is the kind, namespace and name of the object to patch, the patch type is the content type
+	target *unstructured.Unstructured
+}
+
+// objects returns the objects the operation applies to
+func (op operation) objects() ([]*unstructured.Unstructured, error) {
+	if op.target != nil {
+		return []*unstructured.Unstructured{op.target}, nil
+	}
+	return parseObjects(op.body, op.contentType)
+}
+
+// parseOperations returns the objects of each operation, the branch is templated from the objects of the
+// first operation
+func parseOperations(ops []operation) ([][]*unstructured.Unstructured, error) {
+	if len(ops) == 0 {
+		return [][]*unstructured.Unstructured{nil}, nil
+	}
+	objs := make([][]*unstructured.Unstructured, len(ops))
+	for i, op := range ops {
+		var err error
+		if objs[i], err = op.objects(); err != nil {
+			return nil, err
+		}
+	}
+	return objs, nil
+}
+
+// countObjects returns the number of objects across all operations
+func countObjects(objs [][]*unstructured.Unstructured) int {
+	count := 0
+	for _, o := range objs {
+		count += len(o)
+	}
+	return count
+}
+
 func CreateOrUpdateObject(ctx context.Context, logger logr.Logger, git connectors.Connector, api *gitv1.GitopsAPI, contents io.Reader, contentType string) (work *gitv5.Worktree, title string, err error) {
-	addDefaults(api)
 	body, err := ioutil.ReadAll(contents)
 	if err != nil {
 		return
 	}
+	work, title, _, err = applyOperations(ctx, logger, git, api, operation{body: body, contentType: contentType})
+	return
+}
+
+func DeleteObject(ctx context.Context, logger logr.Logger, git connectors.Connector, api *gitv1.GitopsAPI, contents io.Reader, contentType string) (work *gitv5.Worktree, title string, err error) {
+	body, err := ioutil.ReadAll(contents)
+	if err != nil {
+		return
+	}
+	work, title, _, err = applyOperations(ctx, logger, git, api, operation{delete: true, body: body, contentType: contentType})
+	return
+}
+
+// applyOperations checks out the branch templated from the first operation and applies each operation
+// to it in order, returning the worktree, a commit title describing all of the changes and the result for
+// each object
+func applyOperations(ctx context.Context, logger logr.Logger, git connectors.Connector, api *gitv1.GitopsAPI, ops ...operation) (*gitv5.Worktree, string, []ObjectResult, error) {
+	addDefaults(api)
+	objs, err := parseOperations(ops)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	if err := templateBranch(api, objs[0]); err != nil {
+		return nil, "", nil, err
+	}
+	if api.Spec.PullRequest != nil && api.Spec.Branch != api.Spec.Base {
+		if api.Spec.Branch, err = git.WorkBranch(ctx, api.Spec.Base, api.Spec.Branch); err != nil {
+			return nil, "", nil, hostError(err)
+		}
+	}
+	fs, work, err := git.Clone(ctx, api.Spec.Base, api.Spec.Branch)
+	if err != nil {
+		return nil, "", nil, hostError(err)
+	}
+	var updated, patched, deleted []string
+	results := []ObjectResult{}
+	for i, op := range ops {
+		var opResults []ObjectResult
+		var names *[]string
+		if op.target != nil {
+			var result ObjectResult
+			result, err = patchObject(logger, fs, work, api, op.target, op.contentType, op.body)
+			opResults, names = []ObjectResult{result}, &patched
+		} else if op.delete {
+			opResults, err = deleteObjects(logger, fs, work, api, objs[i])
+			names = &deleted
+		} else {
+			opResults, err = updateObjects(logger, fs, work, api, objs[i])
+			names = &updated
+		}
+		if err != nil {
+			return nil, "", nil, &operationError{index: i, err: err}
+		}
+		for _, result := range opResults {
+			if result.Action != ActionUnchanged {
+				*names = append(*names, result.String())
+			}
+		}
+		results = append(results, opResults...)
+	}
+	return work, commitTitle(updated, patched, deleted), results, nil
+}
+
+func parseObjects(body []byte, contentType string) ([]*unstructured.Unstructured, error) {
 	body = []byte(TabToSpace(string(body)))
 	var objs []*unstructured.Unstructured
+	var err error
 	if strings.Contains(contentType, "yaml") || strings.Contains(contentType, "yml") {
 		objs, err = kommons.GetUnstructuredObjects(body)
-		if err != nil {
-			return
-		}
 	} else {
 		objs, err = kommons.GetUnstructuredObjectsFromJson(body)
-		if err != nil {
-			return
-		}
 	}
-	fs, work, err := git.Clone(ctx, api.Spec.Base, api.Spec.Branch)
 	if err != nil {
-		return nil, "", err
+		return nil, fmt.Errorf("%w: %v", ErrInvalidObjects, err)
 	}
+	return objs, nil
+}
+
+// updateObjects creates or merges objs into the checkout and adds them to the kustomization
+func updateObjects(logger logr.Logger, fs billy.Filesystem, work *gitv5.Worktree, api *gitv1.GitopsAPI, objs []*unstructured.Unstructured) ([]ObjectResult, error) {
 	var contentPaths map[string]string
+	var err error
 	if api.Spec.SearchPath != "" {
-		contentPaths, err = getContentPaths(fs.Root(), api.Spec.SearchPath)
+		contentPaths, err = getContentPaths(fs, api.Spec.SearchPath)
 		if err != nil {
-			return nil, "", err
+			return nil, err
 		}
 	}
-	title = "Add/Update "
+	var results []ObjectResult
 	for _, obj := range objs {
 		if err = templateAPIObject(api, obj); err != nil {
-			return
+			return nil, err
 		}
 		contentPath, err := getContentPath(api, obj, contentPaths)
 		if err != nil {
-			return nil, "", err
+			return nil, err
 		}
+		var body []byte
+		action := ActionCreated
 		if contentPath == "" {
 			// need to create a new file with the content
 			contentPath = filepath.Join(api.Spec.SearchPath, fmt.Sprintf("%s-%s-%s.yaml", obj.GetKind(), obj.GetNamespace(), obj.GetName()))
 			body, err = yaml.Marshal(obj)
 			if err != nil {
-				return nil, "", err
+				return nil, err
 			}
 		} else {
-			// file already exists performing merge
-			body, err = performStrategicMerge(filepath.Join(fs.Root(), contentPath), obj)
+			// file may already exist performing merge
+			body, action, err = performStrategicMerge(fs, contentPath, obj)
 			if err != nil {
-				return nil, "", err
+				return nil, err
 			}
 		}
-		title = title + fmt.Sprintf("%s/%s/%s ", obj.GetKind(), obj.GetNamespace(), obj.GetName())
-		logger.Info("Received", "name", api.GetName(), "namespace", api.GetNamespace(), "object", title)
-		logger.Info("Saving to", "path", contentPath, "kustomization", api.Spec.Kustomization, "object", title)
+		result := ObjectResult{Kind: obj.GetKind(), Namespace: obj.GetNamespace(), Name: obj.GetName(), Path: contentPath, Action: action}
+		results = append(results, result)
+		logger.Info("Received", "name", api.GetName(), "namespace", api.GetNamespace(), "object", result.String())
+		logger.Info("Saving to", "path", contentPath, "kustomization", api.Spec.Kustomization, "object", result.String(), "action", action)
 		kustomization, err := GetKustomizaton(fs, api.Spec.Kustomization)
 		if err != nil {
-			return nil, "", err
+			return nil, err
 		}
 		relativePath := strings.Replace(contentPath, path.Dir(api.Spec.Kustomization)+"/", "", -1)
-		if err = copy(body, contentPath, fs, work); err != nil {
-			return nil, "", err
+		if action != ActionUnchanged {
+			if err = copy(body, contentPath, fs, work); err != nil {
+				return nil, err
+			}
 		}
-		index := findElement(kustomization.Resources, relativePath)
-		if index == -1 {
-			kustomization.Resources = append(kustomization.Resources, relativePath)
+		if findElement(kustomization.Resources, relativePath) != -1 {
+			continue
 		}
+		kustomization.Resources = append(kustomization.Resources, relativePath)
 		existingKustomization, err := yaml.Marshal(kustomization)
 		if err != nil {
-			return nil, "", err
+			return nil, err
 		}
 		if err = copy(existingKustomization, api.Spec.Kustomization, fs, work); err != nil {
-			return nil, "", err
+			return nil, err
 		}
 	}
-
-	return work, title, nil
+	return results, nil
 }
 
-func DeleteObject(ctx context.Context, logger logr.Logger, git connectors.Connector, api *gitv1.GitopsAPI, contents io.Reader, contentType string) (work *gitv5.Worktree, title string, err error) {
-	addDefaults(api)
-	body, err := ioutil.ReadAll(contents)
-	if err != nil {
-		return
-	}
-	body = []byte(TabToSpace(string(body)))
-	var objs []*unstructured.Unstructured
-	if strings.Contains(contentType, "yaml") || strings.Contains(contentType, "yml") {
-		objs, err = kommons.GetUnstructuredObjects(body)
-		if err != nil {
-			return
-		}
-	} else {
-		objs, err = kommons.GetUnstructuredObjectsFromJson(body)
-		if err != nil {
-			return
-		}
-	}
-	fs, work, err := git.Clone(ctx, api.Spec.Base, api.Spec.Branch)
-	if err != nil {
-		return
-	}
-	var contentPaths map[string]string
-	if api.Spec.SearchPath != "" {
-		contentPaths, err = getContentPaths(fs.Root(), api.Spec.SearchPath)
-		if err != nil {
-			return nil, "", err
-		}
-	}
-	title = "Delete "
+// deleteObjects removes objs from the checkout, deleting files and kustomization entries that are left
+// empty. ErrObjectNotFound is returned if any of the objects does not exist
+func deleteObjects(logger logr.Logger, fs billy.Filesystem, work *gitv5.Worktree, api *gitv1.GitopsAPI, objs []*unstructured.Unstructured) ([]ObjectResult, error) {
+	var results []ObjectResult
 	for _, obj := range objs {
-		if err = templateAPIObject(api, obj); err != nil {
-			return nil, "", err
+		if err := templateAPIObject(api, obj); err != nil {
+			return nil, err
 		}
-		contentPath, err := getContentPath(api, obj, contentPaths)
+		result := ObjectResult{Kind: obj.GetKind(), Namespace: obj.GetNamespace(), Name: obj.GetName(), Action: ActionDeleted}
+		found, contentPath, err := findObject(fs, api, obj)
 		if err != nil {
-			return nil, "", err
+			return nil, err
 		}
-		if contentPath == "" {
-			return nil, "", fmt.Errorf("could not find the object %v to delete", getObjectKey(obj))
+		if found == nil {
+			return nil, errors.Wrapf(ErrObjectNotFound, "could not find the object %s to delete", result)
 		}
-		title = title + fmt.Sprintf("%s/%s/%s ", obj.GetKind(), obj.GetNamespace(), obj.GetName())
-		logger.Info("Received", "name", api.GetName(), "namespace", api.GetNamespace(), "object", title)
+		result.Path = contentPath
+		results = append(results, result)
+		logger.Info("Received", "name", api.GetName(), "namespace", api.GetNamespace(), "object", result.String())
 
-		logger.Info("Saving to", "path", contentPath, "kustomization", api.Spec.Kustomization, "object", title)
+		logger.Info("Saving to", "path", contentPath, "kustomization", api.Spec.Kustomization, "object", result.String(), "action", ActionDeleted)
 		kustomization, err := GetKustomizaton(fs, api.Spec.Kustomization)
 		if err != nil {
-			return nil, "", err
+			return nil, err
 		}
 		relativePath := strings.Replace(contentPath, path.Dir(api.Spec.Kustomization)+"/", "", -1)
-		body, err = deleteObjectFromFile(filepath.Join(fs.Root(), contentPath), obj)
+		body, err := deleteObjectFromFile(fs, contentPath, obj)
 		if err != nil {
-			return nil, "", err
+			return nil, err
 		}
 		if err = copy(body, contentPath, fs, work); err != nil {
-			return nil, "", err
+			return nil, err
 		}
 		delete, err := isFileEmpty(body)
 		if err != nil {
-			return nil, "", err
+			return nil, err
 		}
 		if delete {
-			if err = deleteFile(contentPath, work, fs.Root()); err != nil {
-				return nil, "", err
+			if err = deleteFile(contentPath, work, fs); err != nil {
+				return nil, err
 			}
 			index := findElement(kustomization.Resources, relativePath)
 			if index != -1 {
 				kustomization.Resources = removeElement(kustomization.Resources, index)
 				existingKustomization, err := yaml.Marshal(kustomization)
 				if err != nil {
-					return nil, "", err
+					return nil, err
 				}
 				if err = copy(existingKustomization, api.Spec.Kustomization, fs, work); err != nil {
-					return nil, "", err
+					return nil, err
 				}
 			}
 		}
 	}
-	return work, title, nil
+	return results, nil
+}
+
+// commitTitle describes the updated, patched and deleted objects, listing at most maxTitleObjects of each
+func commitTitle(updated, patched, deleted []string) string {
+	describe := func(action string, names []string) string {
+		if len(names) > maxTitleObjects {
+			return fmt.Sprintf("%s %s and %d more", action, strings.Join(names[:maxTitleObjects], " "), len(names)-maxTitleObjects)
+		}
+		return fmt.Sprintf("%s %s", action, strings.Join(names, " "))
+	}
+	var title []string
+	if len(updated) > 0 {
+		title = append(title, describe("Add/Update", updated))
+	}
+	if len(patched) > 0 {
+		title = append(title, describe("Patch", patched))
+	}
+	if len(deleted) > 0 {
+		title = append(title, describe("Delete", deleted))
+	}
+	return strings.Join(title, ", ")
 }
 
 func (r *GitopsAPIReconciler) SetupWithManager(mgr ctrl.Manager) error {
@@ -324,12 +727,17 @@ func (r *GitopsAPIReconciler) SetupWithManager(mgr ctrl.Manager) error {
 
 	r.Clientset = clientset
 	r.Client = mgr.GetClient()
+	if r.Workers <= 0 {
+		r.Workers = 4
+	}
+	r.jobs.start(r, r.Workers)
 	if err := ctrl.NewControllerManagedBy(mgr).
 		For(&gitv1.GitopsAPI{}).
 		Complete(r); err != nil {
 		return err
 	}
 	e := echo.New()
+	e.HTTPErrorHandler = httpErrorHandler
 	e.POST("/:namespace/:name/:token", func(c echo.Context) error {
 		return serve(c, r)
 	})
@@ -342,6 +750,39 @@ func (r *GitopsAPIReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	e.POST("/_delete/:namespace/:name/:token", func(c echo.Context) error {
 		return serve(c, r)
 	})
+	e.POST("/_plan/:namespace/:name", func(c echo.Context) error {
+		return serve(c, r)
+	})
+	e.POST("/_plan/:namespace/:name/:token", func(c echo.Context) error {
+		return serve(c, r)
+	})
+	e.GET("/:namespace/:name/objects", func(c echo.Context) error {
+		return getObjects(c, r)
+	})
+	e.GET("/:namespace/:name/objects/:kind/:objName", func(c echo.Context) error {
+		return getObjects(c, r)
+	})
+	e.GET("/:namespace/:name/objects/:kind/:objNamespace/:objName", func(c echo.Context) error {
+		return getObjects(c, r)
+	})
+	e.POST("/_transaction/:namespace/:name", func(c echo.Context) error {
+		return serve(c, r)
+	})
+	e.POST("/_transaction/:namespace/:name/:token", func(c echo.Context) error {
+		return serve(c, r)
+	})
+	e.PATCH("/:namespace/:name/objects/:kind/:objName", func(c echo.Context) error {
+		return serve(c, r)
+	})
+	e.PATCH("/:namespace/:name/objects/:kind/:objNamespace/:objName", func(c echo.Context) error {
+		return serve(c, r)
+	})
+	e.GET("/_pending/:id", func(c echo.Context) error {
+		return getJob(c, r)
+	})
+	e.GET("/_jobs/:id", func(c echo.Context) error {
+		return getJob(c, r)
+	})
 	go func() {
 		e.Logger.Fatal(e.Start(":8888"))
 	}()
@@ -353,12 +794,8 @@ func addDefaults(api *gitv1.GitopsAPI) {
 	if api.Spec.Base == "" {
 		api.Spec.Base = "master"
 	}
-	if api.Spec.Branch == "" {
-		if api.Spec.PullRequest != nil {
-			api.Spec.Branch = slug.Make(api.Spec.PullRequest.Title) + "-" + random.String(4)
-		} else {
-			api.Spec.Branch = api.Spec.Base
-		}
+	if api.Spec.Branch == "" && api.Spec.PullRequest == nil {
+		api.Spec.Branch = api.Spec.Base
 	}
 	if api.Spec.Kustomization == "" {
 		if api.Spec.SearchPath != "" {
@@ -369,11 +806,40 @@ func addDefaults(api *gitv1.GitopsAPI) {
 	}
 }
 
+// templateBranch templates the branch from the first object before cloning. Without an explicit branch
+// the branch is derived from the pull request title, so that repeated requests for the same object push
+// to the same branch and converge on a single pull request
+func templateBranch(api *gitv1.GitopsAPI, objs []*unstructured.Unstructured) (err error) {
+	if len(objs) == 0 {
+		if api.Spec.Branch == "" {
+			api.Spec.Branch = slug.Make(api.Name)
+		}
+		return nil
+	}
+	obj := objs[0]
+	if api.Spec.Branch != "" {
+		api.Spec.Branch, err = text.Template(api.Spec.Branch, obj.Object)
+		return
+	}
+	title, err := text.Template(api.Spec.PullRequest.Title, obj.Object)
+	if err != nil {
+		return
+	}
+	if title == "" {
+		title = fmt.Sprintf("%s-%s-%s", obj.GetKind(), obj.GetNamespace(), obj.GetName())
+	}
+	api.Spec.Branch = slug.Make(title)
+	return nil
+}
+
 func templateAPIObject(api *gitv1.GitopsAPI, obj *unstructured.Unstructured) (err error) {
 	api.Spec.Kustomization, err = text.Template(api.Spec.Kustomization, obj.Object)
 	if err != nil {
 		return
 	}
+	if api.Spec.PullRequest == nil {
+		return nil
+	}
 	api.Spec.PullRequest.Body, err = text.Template(api.Spec.PullRequest.Body, obj.Object)
 	if err != nil {
 		return
@@ -382,6 +848,18 @@ func templateAPIObject(api *gitv1.GitopsAPI, obj *unstructured.Unstructured) (er
 	if err != nil {
 		return
 	}
+	var tags []string
+	for _, tag := range api.Spec.PullRequest.Tags {
+		tag, err = text.Template(tag, obj.Object)
+		if err != nil {
+			return
+		}
+		// tags that template to an empty string are skipped, allowing labels to be conditional
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	api.Spec.PullRequest.Tags = tags
 	return nil
 }
 
@@ -428,48 +906,90 @@ func getObjectKey(obj *unstructured.Unstructured) string {
 	return fmt.Sprintf("%s-%s-%s", obj.GetName(), obj.GetNamespace(), obj.GetKind())
 }
 
-func performStrategicMerge(file string, obj *unstructured.Unstructured) (body []byte, err error) {
-	data, err := ioutil.ReadFile(file)
+// performStrategicMerge merges obj into the object with the same key in file, adding it if the file or object
+// does not exist yet, and returns the new contents of the file and whether the object was created, updated
+// or unchanged
+func performStrategicMerge(fs billy.Filesystem, file string, obj *unstructured.Unstructured) (body []byte, action string, err error) {
+	if _, err := fs.Stat(file); os.IsNotExist(err) {
+		// the templated path does not exist yet
+		body, err = yaml.Marshal(obj)
+		return body, ActionCreated, err
+	}
+	data, err := readFile(fs, file)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 	fileObjs, err := kommons.GetUnstructuredObjects(data)
 	if err != nil {
 		return
 	}
 	index := getObjectIndex(obj, fileObjs)
-	oldObj, err := yaml.Marshal(fileObjs[index])
-	if err != nil {
-		return nil, err
+	if index == -1 {
+		// the templated path exists but contains other objects
+		body, err = replaceObject(data, obj, obj)
+		return body, ActionCreated, err
 	}
-	err = mergo.Merge(&fileObjs[index].Object, obj.Object, mergo.WithOverride)
+	merged := fileObjs[index].DeepCopy()
+	err = mergo.Merge(&merged.Object, obj.Object, mergo.WithOverride)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
-	newObj, err := yaml.Marshal(fileObjs[index])
-	if err != nil {
-		return nil, err
+	if equality.Semantic.DeepEqual(merged.Object, fileObjs[index].Object) {
+		return data, ActionUnchanged, nil
 	}
-	body = []byte(strings.Replace(string(data), string(oldObj), string(newObj), -1))
-	return
+	body, err = replaceObject(data, obj, merged)
+	return body, ActionUpdated, err
 }
 
-func deleteObjectFromFile(file string, obj *unstructured.Unstructured) (body []byte, err error) {
-	data, err := ioutil.ReadFile(file)
+func deleteObjectFromFile(fs billy.Filesystem, file string, obj *unstructured.Unstructured) (body []byte, err error) {
+	data, err := readFile(fs, file)
 	if err != nil {
 		return nil, err
 	}
-	fileObjs, err := kommons.GetUnstructuredObjects(data)
-	if err != nil {
-		return
+	return replaceObject(data, obj, nil)
+}
+
+var documentSeparator = regexp.MustCompile(`(?m)^---[ \t]*$`)
+
+// replaceObject replaces the document containing obj in a multi document YAML file with replacement, leaving
+// the other documents untouched. obj is removed if replacement is nil, and appended if it is not found
+func replaceObject(data []byte, obj, replacement *unstructured.Unstructured) ([]byte, error) {
+	var docs []string
+	found := false
+	for _, doc := range documentSeparator.Split(string(data), -1) {
+		doc = strings.Trim(doc, "\n")
+		if strings.TrimSpace(doc) == "" {
+			continue
+		}
+		objs, err := kommons.GetUnstructuredObjects([]byte(doc))
+		if err != nil {
+			return nil, err
+		}
+		if len(objs) != 1 || getObjectKey(objs[0]) != getObjectKey(obj) {
+			docs = append(docs, doc)
+			continue
+		}
+		found = true
+		if replacement == nil {
+			continue
+		}
+		body, err := yaml.Marshal(replacement)
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, strings.TrimSuffix(string(body), "\n"))
 	}
-	index := getObjectIndex(obj, fileObjs)
-	oldObj, err := yaml.Marshal(fileObjs[index])
-	if err != nil {
-		return nil, err
+	if !found && replacement != nil {
+		body, err := yaml.Marshal(replacement)
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, strings.TrimSuffix(string(body), "\n"))
 	}
-	body = []byte(strings.Replace(string(data), string(oldObj), "", -1))
-	return
+	if len(docs) == 0 {
+		return []byte{}, nil
+	}
+	return []byte(strings.Join(docs, "\n---\n") + "\n"), nil
 }
 
 func getObjectIndex(obj *unstructured.Unstructured, fileObjs []*unstructured.Unstructured) (index int) {
@@ -491,10 +1011,19 @@ func isFileEmpty(data []byte) (bool, error) {
 	return len(fileObjs) == 0, nil
 }
 
-func getContentPaths(repoRoot, searchPath string) (map[string]string, error) {
+func getContentPaths(fs billy.Filesystem, searchPath string) (map[string]string, error) {
 	contentPaths := make(map[string]string)
-	walkPath := filepath.Join(repoRoot, searchPath)
-	if err := filepath.Walk(walkPath, func(filePath string, info os.FileInfo, err error) error {
+	if err := walkObjects(fs, searchPath, func(filePath string, obj *unstructured.Unstructured) {
+		contentPaths[getObjectKey(obj)] = filePath
+	}); err != nil {
+		return nil, err
+	}
+	return contentPaths, nil
+}
+
+// walkObjects calls fn with each object found in the YAML files under searchPath, excluding kustomizations
+func walkObjects(fs billy.Filesystem, searchPath string, fn func(filePath string, obj *unstructured.Unstructured)) error {
+	return walk(fs, filepath.Clean(searchPath), func(filePath string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
@@ -502,7 +1031,7 @@ func getContentPaths(repoRoot, searchPath string) (map[string]string, error) {
 			return nil
 		}
 		if path.Ext(filePath) == ".yaml" || path.Ext(filePath) == ".yml" {
-			buf, err := ioutil.ReadFile(filePath)
+			buf, err := readFile(fs, filePath)
 			if err != nil {
 				return err
 			}
@@ -511,15 +1040,9 @@ func getContentPaths(repoRoot, searchPath string) (map[string]string, error) {
 				return err
 			}
 			for _, resource := range resources {
-				contentPaths[getObjectKey(resource)], err = filepath.Rel(repoRoot, filePath)
-				if err != nil {
-					return err
-				}
+				fn(filePath, resource)
 			}
 		}
 		return nil
-	}); err != nil {
-		return nil, err
-	}
-	return contentPaths, nil
+	})
 }
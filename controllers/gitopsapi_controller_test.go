@@ -0,0 +1,302 @@
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	gitv1 "github.com/flanksource/git-operator/api/v1"
+	"github.com/flanksource/kommons"
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+func TestTruncatePullRequests(t *testing.T) {
+	var prs []gitv1.PullRequestStatus
+	// 15 merged pull requests, newest first, with an old open pull request at the end
+	for i := 16; i > 1; i-- {
+		prs = append(prs, gitv1.PullRequestStatus{Number: i, State: gitv1.PullRequestStateMerged})
+	}
+	prs = append(prs, gitv1.PullRequestStatus{Number: 1, State: gitv1.PullRequestStateOpen})
+
+	truncated := truncatePullRequests(prs)
+	if len(truncated) != maxPullRequestStatuses {
+		t.Fatalf("expected %d pull requests, got %d", maxPullRequestStatuses, len(truncated))
+	}
+	if last := truncated[len(truncated)-1]; last.Number != 1 || last.State != gitv1.PullRequestStateOpen {
+		t.Errorf("expected the open pull request to be kept, got %v", last)
+	}
+	if truncated[0].Number != 16 || truncated[maxPullRequestStatuses-2].Number != 8 {
+		t.Errorf("expected the newest merged pull requests to be kept, got %v", truncated)
+	}
+
+	var open []gitv1.PullRequestStatus
+	for i := 12; i > 0; i-- {
+		open = append(open, gitv1.PullRequestStatus{Number: i, State: gitv1.PullRequestStateOpen})
+	}
+	if truncated := truncatePullRequests(append(open, gitv1.PullRequestStatus{Number: 13, State: gitv1.PullRequestStateClosed})); !reflect.DeepEqual(truncated, open) {
+		t.Errorf("expected only the open pull requests, got %v", truncated)
+	}
+}
+
+func newConfigMap(name string, data map[string]interface{}) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "ConfigMap",
+		"metadata":   map[string]interface{}{"name": name, "namespace": "default"},
+	}}
+	if data != nil {
+		obj.Object["data"] = data
+	}
+	return obj
+}
+
+// configMapOperation returns an operation that creates or deletes a ConfigMap
+func configMapOperation(t *testing.T, name string, delete bool) operation {
+	body, err := newConfigMap(name, map[string]interface{}{"key": name}).MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return operation{delete: delete, body: []byte("[" + string(body) + "]"), contentType: "application/json"}
+}
+
+const multiDocument = `# managed by git-operator
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: a
+  namespace: default
+data:
+  key: a
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: b
+  namespace: default
+data:
+  key: b
+`
+
+func TestReplaceObject(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        string
+		obj         *unstructured.Unstructured
+		replacement *unstructured.Unstructured
+		expected    string
+	}{
+		{
+			name:        "replace",
+			data:        multiDocument,
+			obj:         newConfigMap("b", nil),
+			replacement: newConfigMap("b", map[string]interface{}{"key": "c"}),
+			expected: `# managed by git-operator
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: a
+  namespace: default
+data:
+  key: a
+---
+apiVersion: v1
+data:
+  key: c
+kind: ConfigMap
+metadata:
+  name: b
+  namespace: default
+`,
+		},
+		{
+			name: "delete",
+			data: multiDocument,
+			obj:  newConfigMap("a", nil),
+			expected: `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: b
+  namespace: default
+data:
+  key: b
+`,
+		},
+		{
+			name:     "delete the last object",
+			data:     "---\n" + strings.SplitN(multiDocument, "---\n", 2)[1],
+			obj:      newConfigMap("b", nil),
+			expected: "",
+		},
+		{
+			name:        "append",
+			data:        strings.SplitN(multiDocument, "---\n", 2)[1],
+			obj:         newConfigMap("c", nil),
+			replacement: newConfigMap("c", nil),
+			expected: `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: b
+  namespace: default
+data:
+  key: b
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: c
+  namespace: default
+`,
+		},
+		{
+			name:     "delete a missing object",
+			data:     multiDocument,
+			obj:      newConfigMap("c", nil),
+			expected: multiDocument,
+		},
+	}
+	for _, test := range tests {
+		body, err := replaceObject([]byte(test.data), test.obj, test.replacement)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if string(body) != test.expected {
+			t.Errorf("%s: expected\n%s\ngot\n%s", test.name, test.expected, string(body))
+		}
+	}
+}
+
+func TestPerformStrategicMerge(t *testing.T) {
+	fs := memfs.New()
+	if err := util.WriteFile(fs, "configmaps.yaml", []byte(multiDocument), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		file   string
+		obj    *unstructured.Unstructured
+		action string
+		data   map[string]string
+	}{
+		{name: "new file", file: "missing.yaml", obj: newConfigMap("a", nil), action: ActionCreated, data: map[string]string{"a": ""}},
+		{name: "new object", file: "configmaps.yaml", obj: newConfigMap("c", map[string]interface{}{"key": "c"}), action: ActionCreated, data: map[string]string{"a": "a", "b": "b", "c": "c"}},
+		{name: "merged", file: "configmaps.yaml", obj: newConfigMap("b", map[string]interface{}{"key": "c"}), action: ActionUpdated, data: map[string]string{"a": "a", "b": "c"}},
+		{name: "unchanged", file: "configmaps.yaml", obj: newConfigMap("b", map[string]interface{}{"key": "b"}), action: ActionUnchanged, data: map[string]string{"a": "a", "b": "b"}},
+	}
+	for _, test := range tests {
+		body, action, err := performStrategicMerge(fs, test.file, test.obj)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if action != test.action {
+			t.Errorf("%s: expected %s, got %s", test.name, test.action, action)
+		}
+		objs, err := kommons.GetUnstructuredObjects(body)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		data := map[string]string{}
+		for _, obj := range objs {
+			data[obj.GetName()], _, _ = unstructured.NestedString(obj.Object, "data", "key")
+		}
+		if !reflect.DeepEqual(data, test.data) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.data, data)
+		}
+	}
+}
+
+func TestApplyOperationsWorkBranch(t *testing.T) {
+	tests := []struct {
+		name         string
+		spec         gitv1.GitopsAPISpec
+		workBranches []string
+	}{
+		{name: "no pull request", spec: gitv1.GitopsAPISpec{Base: "master", Branch: "feature"}},
+		{name: "base branch", spec: gitv1.GitopsAPISpec{Base: "master", Branch: "master", PullRequest: &gitv1.PullRequestTemplate{}}},
+		{name: "pull request", spec: gitv1.GitopsAPISpec{Base: "master", Branch: "feature", PullRequest: &gitv1.PullRequestTemplate{}}, workBranches: []string{"feature"}},
+	}
+	for _, test := range tests {
+		git := newFakeConnector(t)
+		api := &gitv1.GitopsAPI{Spec: test.spec}
+		if _, _, _, err := applyOperations(context.Background(), logf.Log, git, api); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(git.workBranches, test.workBranches) {
+			t.Errorf("%s: expected the work branch to be looked up for %v, got %v", test.name, test.workBranches, git.workBranches)
+		}
+	}
+}
+
+// newTestReconciler returns a reconciler backed by a fake client that contains api
+func newTestReconciler(t *testing.T, api *gitv1.GitopsAPI) *GitopsAPIReconciler {
+	scheme := runtime.NewScheme()
+	if err := gitv1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	return &GitopsAPIReconciler{
+		Client: fake.NewFakeClientWithScheme(scheme, api),
+		Log:    logf.Log,
+		Scheme: scheme,
+	}
+}
+
+func TestCommitOpensPullRequestAfterFailure(t *testing.T) {
+	api := &gitv1.GitopsAPI{
+		ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default"},
+		Spec: gitv1.GitopsAPISpec{
+			GitRepository: "https://github.com/flanksource/git-operator",
+			Base:          "master",
+			Branch:        "feature",
+			PullRequest:   &gitv1.PullRequestTemplate{Title: "update"},
+		},
+	}
+	r := newTestReconciler(t, api)
+	git := newFakeConnector(t)
+	op := configMapOperation(t, "a", false)
+
+	// the commit is pushed but the pull request cannot be opened
+	git.openErr = errors.New("service unavailable")
+	result, err := r.commit(context.Background(), git, api, false, op)
+	if err == nil {
+		t.Fatal("expected opening the pull request to fail")
+	}
+	if result == nil || result.Commit == "" {
+		t.Fatalf("expected the pushed commit to be returned with the error, got %v", result)
+	}
+	if !reflect.DeepEqual(git.pushed, []string{"feature:master"}) {
+		t.Errorf("expected feature to be pushed, got %v", git.pushed)
+	}
+
+	// retrying changes nothing, but the pull request is still opened
+	git.openErr = nil
+	result, err = r.commit(context.Background(), git, api, false, op)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Commit != "" || result.PullRequest != 1 {
+		t.Errorf("expected no commit and pull request 1, got %v", result)
+	}
+	if !reflect.DeepEqual(git.pullRequests, []string{"feature"}) {
+		t.Errorf("expected a pull request from feature, got %v", git.pullRequests)
+	}
+
+	// without commits on the branch there is no pull request to open
+	api.Spec.Branch = "empty"
+	if _, err := r.commit(context.Background(), git, api, false); err != nil {
+		t.Fatal(err)
+	}
+	if len(git.pullRequests) != 1 {
+		t.Errorf("expected no pull request from an empty branch, got %v", git.pullRequests)
+	}
+}
@@ -0,0 +1,224 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	gitv1 "github.com/flanksource/git-operator/api/v1"
+	"github.com/flanksource/git-operator/connectors"
+	"github.com/go-logr/logr"
+	"github.com/labstack/echo"
+	"github.com/labstack/gommon/random"
+	"github.com/pkg/errors"
+)
+
+const (
+	// the batch is still accepting requests
+	JobStatePending   = "pending"
+	JobStateQueued    = "queued"
+	JobStateRunning   = "running"
+	JobStateCommitted = "committed"
+	JobStateFailed    = "failed"
+
+	// the number of jobs waiting for a worker before new asynchronous requests are rejected
+	maxQueuedJobs = 100
+	// how long the status of a job can be polled for once it has finished
+	jobStatusRetention = time.Hour
+)
+
+// ErrJobQueueFull is returned when an asynchronous request cannot be queued
+var ErrJobQueueFull = errors.New("too many queued requests")
+
+// JobStatus is returned when polling /_jobs/:id, or /_pending/:id for batched requests. Each batched request
+// has its own status, as a request that fails is left out of the commit of the others.
+type JobStatus struct {
+	ID    string `json:"id"`
+	State string `json:"state"`
+	// the number of requests and objects in the job, or in the batch of a batched request
+	Requests       int    `json:"requests"`
+	Objects        int    `json:"objects"`
+	Commit         string `json:"commit,omitempty"`
+	PullRequest    int    `json:"pullRequest,omitempty"`
+	PullRequestURL string `json:"pullRequestURL,omitempty"`
+	// Set when the commit was pushed but no pull request was opened, because the provider does not support them
+	PullRequestsUnsupported bool   `json:"pullRequestsUnsupported,omitempty"`
+	Error                   string `json:"error,omitempty"`
+}
+
+type job struct {
+	status   JobStatus
+	api      *gitv1.GitopsAPI
+	ops      []operation
+	finished time.Time
+	// requests are the jobs of the requests coalesced by a batch, which are committed together and each
+	// report their own status. It is nil for asynchronous requests, which report the status of the job.
+	requests []*job
+}
+
+// jobQueue commits asynchronous requests and batches on a fixed number of workers
+type jobQueue struct {
+	lock  sync.Mutex
+	jobs  map[string]*job
+	queue chan *job
+}
+
+func (q *jobQueue) start(r *GitopsAPIReconciler, workers int) {
+	q.queue = make(chan *job, maxQueuedJobs)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for j := range q.queue {
+				q.run(r, j)
+			}
+		}()
+	}
+}
+
+// newJob registers a job for requests to api, which can be polled from then on
+func (q *jobQueue) newJob(api *gitv1.GitopsAPI, state string) *job {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.jobs == nil {
+		q.jobs = map[string]*job{}
+	}
+	for id, j := range q.jobs {
+		if !j.finished.IsZero() && time.Since(j.finished) > jobStatusRetention {
+			delete(q.jobs, id)
+		}
+	}
+	j := &job{
+		status: JobStatus{ID: random.String(16, random.Lowercase, random.Numeric), State: state},
+		api:    api.DeepCopy(),
+	}
+	q.jobs[j.status.ID] = j
+	return j
+}
+
+// submit queues the operations of a request to be committed by a worker and returns the ID of the job
+func (q *jobQueue) submit(api *gitv1.GitopsAPI, ops ...operation) (string, error) {
+	objs, err := parseOperations(ops)
+	if err != nil {
+		return "", err
+	}
+	j := q.newJob(api, JobStateQueued)
+	j.ops = ops
+	q.update(j, func(status *JobStatus) {
+		status.Requests = 1
+		status.Objects = countObjects(objs)
+	})
+	select {
+	case q.queue <- j:
+		return j.status.ID, nil
+	default:
+		q.lock.Lock()
+		delete(q.jobs, j.status.ID)
+		q.lock.Unlock()
+		return "", ErrJobQueueFull
+	}
+}
+
+func (q *jobQueue) update(j *job, fn func(status *JobStatus)) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	fn(&j.status)
+}
+
+func (q *jobQueue) run(r *GitopsAPIReconciler, j *job) {
+	requests := j.requests
+	if requests == nil {
+		requests = []*job{j}
+	}
+	for _, request := range requests {
+		q.update(request, func(status *JobStatus) {
+			status.State = JobStateRunning
+		})
+	}
+	ctx := context.Background()
+	log := r.Log.WithValues("job", requests[0].status.ID)
+	log.Info("Running job", "requests", len(requests))
+	var result *Result
+	git, err := connectors.NewConnector(ctx, r.Client, r.Clientset, log, j.api.Namespace, &j.api.Spec)
+	if err == nil {
+		result, requests, err = q.commit(ctx, log, r, git, j.api, requests)
+		git.Close() // nolint: errcheck
+	}
+	if errors.Is(err, connectors.ErrPullRequestsUnsupported) {
+		err = nil
+	}
+	if err != nil {
+		log.Error(err, "job failed")
+	}
+	for _, request := range requests {
+		q.finish(request, result, err)
+	}
+}
+
+// commit commits the operations of requests together and returns the requests that were committed. If an
+// operation fails, the request it belongs to fails and the other requests are committed again without it.
+func (q *jobQueue) commit(ctx context.Context, log logr.Logger, r *GitopsAPIReconciler, git connectors.Connector, api *gitv1.GitopsAPI, requests []*job) (*Result, []*job, error) {
+	for {
+		var ops []operation
+		// the request each operation belongs to
+		var owners []*job
+		for _, request := range requests {
+			ops = append(ops, request.ops...)
+			for range request.ops {
+				owners = append(owners, request)
+			}
+		}
+		result, err := r.commit(ctx, git, api, len(requests) > 1, ops...)
+		var opErr *operationError
+		if len(requests) == 1 || !errors.As(err, &opErr) {
+			return result, requests, err
+		}
+		failed := owners[opErr.index]
+		log.Error(err, "request failed, committing the other requests without it", "request", failed.status.ID)
+		q.finish(failed, nil, err)
+		var remaining []*job
+		for _, request := range requests {
+			if request != failed {
+				remaining = append(remaining, request)
+			}
+		}
+		requests = remaining
+	}
+}
+
+// finish records the result of a job, or the error it failed with
+func (q *jobQueue) finish(j *job, result *Result, err error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	j.finished = time.Now()
+	if result != nil {
+		j.status.Commit = result.Commit
+		j.status.PullRequest = result.PullRequest
+		j.status.PullRequestURL = result.PullRequestURL
+		j.status.PullRequestsUnsupported = result.PullRequestsUnsupported
+	}
+	if err != nil {
+		j.status.State = JobStateFailed
+		j.status.Error = err.Error()
+	} else {
+		j.status.State = JobStateCommitted
+	}
+}
+
+func (q *jobQueue) get(id string) (JobStatus, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	j, found := q.jobs[id]
+	if !found {
+		return JobStatus{}, false
+	}
+	return j.status, true
+}
+
+func getJob(c echo.Context, r *GitopsAPIReconciler) error {
+	status, found := r.jobs.get(c.Param("id"))
+	if !found {
+		return respondError(c, echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("job %s not found", c.Param("id"))))
+	}
+	return c.JSON(http.StatusOK, status)
+}
@@ -0,0 +1,71 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	gitv1 "github.com/flanksource/git-operator/api/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+func TestBatchSkipsFailedRequests(t *testing.T) {
+	api := &gitv1.GitopsAPI{
+		ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default"},
+		Spec: gitv1.GitopsAPISpec{
+			GitRepository: "https://github.com/flanksource/git-operator",
+			Base:          "master",
+			Branch:        "batch",
+			// the batch is flushed by the third request rather than the window
+			Batch: &gitv1.BatchSpec{Window: metav1.Duration{Duration: time.Hour}, MaxObjects: 3},
+		},
+	}
+	r := newTestReconciler(t, api)
+	r.jobs.queue = make(chan *job, 1)
+	var ids []string
+	for _, op := range []operation{
+		configMapOperation(t, "a", false),
+		// deleting an object that does not exist fails
+		configMapOperation(t, "missing", true),
+		configMapOperation(t, "b", false),
+	} {
+		id, err := r.batches.add(r, api, op)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	batch := <-r.jobs.queue
+	if len(batch.requests) != 3 {
+		t.Fatalf("expected 3 requests in the batch, got %d", len(batch.requests))
+	}
+
+	git := newFakeConnector(t)
+	result, committed, err := r.jobs.commit(context.Background(), logf.Log, r, git, batch.api, batch.requests)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(committed) != 2 || committed[0].status.ID != ids[0] || committed[1].status.ID != ids[2] {
+		t.Errorf("expected the first and last request to be committed, got %v", committed)
+	}
+	if len(result.Objects) != 2 {
+		t.Errorf("expected 2 objects to be committed, got %v", result.Objects)
+	}
+	for _, request := range committed {
+		r.jobs.finish(request, result, nil)
+	}
+
+	for i, state := range []string{JobStateCommitted, JobStateFailed, JobStateCommitted} {
+		status, found := r.jobs.get(ids[i])
+		if !found {
+			t.Fatalf("request %d not found", i)
+		}
+		if status.State != state {
+			t.Errorf("expected request %d to be %s, got %s: %s", i, state, status.State, status.Error)
+		}
+		if state == JobStateCommitted && status.Commit != result.Commit {
+			t.Errorf("expected request %d to report commit %s, got %s", i, result.Commit, status.Commit)
+		}
+	}
+}
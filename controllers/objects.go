@@ -0,0 +1,157 @@
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"path"
+	"strings"
+
+	gitv1 "github.com/flanksource/git-operator/api/v1"
+	"github.com/flanksource/git-operator/connectors"
+	"github.com/flanksource/kommons"
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/labstack/echo"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/yaml"
+)
+
+// getObjects returns the objects stored in the repository for a GitopsAPI, either a single object addressed
+// by kind, namespace and name or all objects as a List. Objects are read from the base branch, or from the
+// branch passed as ?branch=
+func getObjects(c echo.Context, r *GitopsAPIReconciler) error {
+	ctx := context.Background()
+	api, err := getAPI(ctx, c, r)
+	if err != nil {
+		return err
+	}
+	addDefaults(api)
+	branch := c.QueryParam("branch")
+	if branch == "" {
+		branch = api.Spec.Base
+	}
+	git, err := connectors.NewConnector(ctx, r.Client, r.Clientset, r.Log, api.Namespace, &api.Spec)
+	if err != nil {
+		return respondError(c, err)
+	}
+	defer git.Close() // nolint: errcheck
+	fs, _, err := git.Clone(ctx, branch, branch)
+	if errors.Is(err, plumbing.ErrReferenceNotFound) {
+		return respondError(c, echo.NewHTTPError(http.StatusNotFound, err.Error()))
+	}
+	if err != nil {
+		return respondError(c, hostError(err))
+	}
+
+	if c.Param("kind") == "" {
+		objs, err := listObjects(fs, api)
+		if err != nil {
+			return respondError(c, err)
+		}
+		items := []interface{}{}
+		for _, obj := range objs {
+			items = append(items, obj.Object)
+		}
+		return respondObject(c, map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "List",
+			"items":      items,
+		})
+	}
+
+	obj := &unstructured.Unstructured{}
+	obj.SetKind(c.Param("kind"))
+	obj.SetNamespace(c.Param("objNamespace"))
+	obj.SetName(c.Param("objName"))
+	found, _, err := findObject(fs, api, obj)
+	if err != nil {
+		return respondError(c, err)
+	}
+	if found == nil {
+		return respondError(c, errors.Wrapf(ErrObjectNotFound, "could not find the object %s/%s/%s", obj.GetKind(), obj.GetNamespace(), obj.GetName()))
+	}
+	return respondObject(c, found.Object)
+}
+
+// respondObject responds with obj as YAML if the client accepts it, or as JSON otherwise
+func respondObject(c echo.Context, obj map[string]interface{}) error {
+	if !strings.Contains(c.Request().Header.Get(echo.HeaderAccept), "yaml") {
+		return c.JSON(http.StatusOK, obj)
+	}
+	body, err := yaml.Marshal(obj)
+	if err != nil {
+		return respondError(c, err)
+	}
+	return c.Blob(http.StatusOK, "application/yaml", body)
+}
+
+// findObject returns the object in the repository with the kind, namespace and name of obj and the path of
+// the file containing it, or nil if it is not found. The path is resolved the same way as for updates, falling
+// back to searching all objects for paths templated from fields other than the kind, namespace and name
+func findObject(fs billy.Filesystem, api *gitv1.GitopsAPI, obj *unstructured.Unstructured) (found *unstructured.Unstructured, contentPath string, err error) {
+	var contentPaths map[string]string
+	if api.Spec.SearchPath != "" {
+		contentPaths, err = getContentPaths(fs, api.Spec.SearchPath)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	contentPath, err = getContentPath(api, obj, contentPaths)
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err := fs.Stat(contentPath); contentPath != "" && err == nil {
+		data, err := readFile(fs, contentPath)
+		if err != nil {
+			return nil, "", err
+		}
+		fileObjs, err := kommons.GetUnstructuredObjects(data)
+		if err != nil {
+			return nil, "", err
+		}
+		if index := getObjectIndex(obj, fileObjs); index != -1 {
+			return fileObjs[index], contentPath, nil
+		}
+	}
+	if api.Spec.SearchPath != "" {
+		return nil, "", nil
+	}
+	contentPath = ""
+	err = walkAPIObjects(fs, api, func(filePath string, fileObj *unstructured.Unstructured) {
+		if found == nil && getObjectKey(fileObj) == getObjectKey(obj) {
+			found, contentPath = fileObj, filePath
+		}
+	})
+	return found, contentPath, err
+}
+
+// listObjects returns all objects stored in the repository for the GitopsAPI
+func listObjects(fs billy.Filesystem, api *gitv1.GitopsAPI) ([]*unstructured.Unstructured, error) {
+	var objs []*unstructured.Unstructured
+	if err := walkAPIObjects(fs, api, func(filePath string, obj *unstructured.Unstructured) {
+		objs = append(objs, obj)
+	}); err != nil {
+		return nil, err
+	}
+	return objs, nil
+}
+
+// walkAPIObjects calls fn with each object under the search path, or under the directory of the path up to
+// the first templated value if there is no search path
+func walkAPIObjects(fs billy.Filesystem, api *gitv1.GitopsAPI, fn func(filePath string, obj *unstructured.Unstructured)) error {
+	dir := api.Spec.SearchPath
+	if dir == "" {
+		dir = api.Spec.Path
+		if index := strings.Index(dir, "{{"); index != -1 {
+			dir = dir[:index]
+		}
+		if !strings.HasSuffix(dir, "/") {
+			dir = path.Dir(dir)
+		}
+	}
+	if _, err := fs.Stat(path.Clean(dir)); err != nil {
+		return nil
+	}
+	return walkObjects(fs, dir, fn)
+}
@@ -0,0 +1,122 @@
+package controllers
+
+import (
+	"fmt"
+	"strings"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	gitv1 "github.com/flanksource/git-operator/api/v1"
+	"github.com/go-git/go-billy/v5"
+	gitv5 "github.com/go-git/go-git/v5"
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/yaml"
+)
+
+var (
+	// ErrObjectNotFound is returned when the object to patch does not exist in the repository
+	ErrObjectNotFound = errors.New("object not found")
+	// ErrInvalidPatch is returned when a patch cannot be decoded or applied
+	ErrInvalidPatch = errors.New("invalid patch")
+	// ErrUnsupportedPatchType is returned for unknown patch content types, and for strategic merge patches
+	// of kinds without a registered Go type e.g. custom resources
+	ErrUnsupportedPatchType = errors.New("unsupported patch type")
+)
+
+// patchType returns the type of patch sent with contentType, ignoring any parameters
+func patchType(contentType string) (k8stypes.PatchType, error) {
+	switch patch := k8stypes.PatchType(strings.TrimSpace(strings.Split(contentType, ";")[0])); patch {
+	case k8stypes.JSONPatchType, k8stypes.MergePatchType, k8stypes.StrategicMergePatchType:
+		return patch, nil
+	}
+	return "", fmt.Errorf("%w %q, expected %s, %s or %s", ErrUnsupportedPatchType, contentType, k8stypes.JSONPatchType, k8stypes.MergePatchType, k8stypes.StrategicMergePatchType)
+}
+
+// patchObject applies patch to the object in the repository with the kind, namespace and name of target and
+// saves it back to the same file
+func patchObject(logger logr.Logger, fs billy.Filesystem, work *gitv5.Worktree, api *gitv1.GitopsAPI, target *unstructured.Unstructured, contentType string, patch []byte) (ObjectResult, error) {
+	result := ObjectResult{Kind: target.GetKind(), Namespace: target.GetNamespace(), Name: target.GetName(), Action: ActionUpdated}
+	if err := templateAPIObject(api, target); err != nil {
+		return result, err
+	}
+	obj, contentPath, err := findObject(fs, api, target)
+	if err != nil {
+		return result, err
+	}
+	if obj == nil {
+		return result, errors.Wrapf(ErrObjectNotFound, "could not find the object %s to patch", result)
+	}
+	result.Path = contentPath
+	patched, err := applyPatch(obj, contentType, patch)
+	if err != nil {
+		return result, err
+	}
+	if equality.Semantic.DeepEqual(patched.Object, obj.Object) {
+		result.Action = ActionUnchanged
+		return result, nil
+	}
+	logger.Info("Patching", "name", api.GetName(), "namespace", api.GetNamespace(), "object", result.String(), "path", contentPath)
+	data, err := readFile(fs, contentPath)
+	if err != nil {
+		return result, err
+	}
+	body, err := replaceObject(data, obj, patched)
+	if err != nil {
+		return result, err
+	}
+	return result, copy(body, contentPath, fs, work)
+}
+
+// applyPatch applies a JSON patch, JSON merge patch or strategic merge patch to obj the same way as the
+// Kubernetes API server does, patches can also be sent as YAML
+func applyPatch(obj *unstructured.Unstructured, contentType string, patch []byte) (*unstructured.Unstructured, error) {
+	patchType, err := patchType(contentType)
+	if err != nil {
+		return nil, err
+	}
+	patch, err = yaml.YAMLToJSON(patch)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPatch, err)
+	}
+	original, err := obj.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	var patched []byte
+	switch patchType {
+	case k8stypes.JSONPatchType:
+		var operations jsonpatch.Patch
+		operations, err = jsonpatch.DecodePatch(patch)
+		if err == nil {
+			patched, err = operations.Apply(original)
+		}
+	case k8stypes.MergePatchType:
+		patched, err = jsonpatch.MergePatch(original, patch)
+	case k8stypes.StrategicMergePatchType:
+		var typed runtime.Object
+		typed, err = scheme.Scheme.New(obj.GroupVersionKind())
+		if runtime.IsNotRegisteredError(err) {
+			return nil, fmt.Errorf("%w: strategic merge patches are not supported for %s, use a merge patch instead", ErrUnsupportedPatchType, obj.GroupVersionKind())
+		}
+		if err == nil {
+			patched, err = strategicpatch.StrategicMergePatch(original, patch, typed)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPatch, err)
+	}
+	result := &unstructured.Unstructured{}
+	if err := result.UnmarshalJSON(patched); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPatch, err)
+	}
+	if getObjectKey(result) != getObjectKey(obj) {
+		return nil, fmt.Errorf("%w: the kind, namespace and name of an object cannot be patched", ErrInvalidPatch)
+	}
+	return result, nil
+}
@@ -0,0 +1,120 @@
+package controllers
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestApplyPatch(t *testing.T) {
+	deployment := func() *unstructured.Unstructured {
+		return &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": "apps/v1",
+			"kind":       "Deployment",
+			"metadata":   map[string]interface{}{"name": "app", "namespace": "default"},
+			"spec": map[string]interface{}{
+				"replicas": int64(1),
+				"template": map[string]interface{}{
+					"spec": map[string]interface{}{
+						"containers": []interface{}{
+							map[string]interface{}{"name": "app", "image": "app:v1"},
+							map[string]interface{}{"name": "sidecar", "image": "sidecar:v1"},
+						},
+					},
+				},
+			},
+		}}
+	}
+	tests := []struct {
+		name        string
+		obj         *unstructured.Unstructured
+		contentType string
+		patch       string
+		path        []string
+		expected    interface{}
+		err         error
+	}{
+		{
+			name:        "json patch",
+			obj:         deployment(),
+			contentType: "application/json-patch+json",
+			patch:       `[{"op": "replace", "path": "/spec/replicas", "value": 3}]`,
+			path:        []string{"spec", "replicas"},
+			expected:    int64(3),
+		},
+		{
+			name:        "merge patch replaces lists",
+			obj:         deployment(),
+			contentType: "application/merge-patch+json; charset=utf-8",
+			patch:       `{"spec": {"template": {"spec": {"containers": [{"name": "app", "image": "app:v2"}]}}}}`,
+			path:        []string{"spec", "template", "spec", "containers"},
+			expected:    []interface{}{map[string]interface{}{"name": "app", "image": "app:v2"}},
+		},
+		{
+			name:        "strategic merge patch merges lists by key",
+			obj:         deployment(),
+			contentType: "application/strategic-merge-patch+json",
+			patch:       "spec:\n  template:\n    spec:\n      containers:\n      - name: app\n        image: app:v2\n",
+			path:        []string{"spec", "template", "spec", "containers"},
+			expected: []interface{}{
+				map[string]interface{}{"name": "app", "image": "app:v2"},
+				map[string]interface{}{"name": "sidecar", "image": "sidecar:v1"},
+			},
+		},
+		{
+			name: "strategic merge patch of a custom resource",
+			obj: &unstructured.Unstructured{Object: map[string]interface{}{
+				"apiVersion": "example.com/v1",
+				"kind":       "Widget",
+				"metadata":   map[string]interface{}{"name": "widget"},
+			}},
+			contentType: "application/strategic-merge-patch+json",
+			patch:       `{"spec": {}}`,
+			err:         ErrUnsupportedPatchType,
+		},
+		{
+			name:        "unknown patch type",
+			obj:         deployment(),
+			contentType: "application/json",
+			patch:       `{}`,
+			err:         ErrUnsupportedPatchType,
+		},
+		{
+			name:        "invalid patch",
+			obj:         deployment(),
+			contentType: "application/json-patch+json",
+			patch:       `[{"op": "remove", "path": "/spec/missing"}]`,
+			err:         ErrInvalidPatch,
+		},
+		{
+			name:        "renaming the object",
+			obj:         deployment(),
+			contentType: "application/merge-patch+json",
+			patch:       `{"metadata": {"name": "other"}}`,
+			err:         ErrInvalidPatch,
+		},
+	}
+	for _, test := range tests {
+		patched, err := applyPatch(test.obj, test.contentType, []byte(test.patch))
+		if test.err != nil {
+			if !errors.Is(err, test.err) {
+				t.Errorf("%s: expected %v, got %v", test.name, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		value, _, err := unstructured.NestedFieldNoCopy(patched.Object, test.path...)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(value, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, value)
+		}
+	}
+}
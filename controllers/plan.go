@@ -0,0 +1,158 @@
+package controllers
+
+import (
+	"context"
+	"path"
+
+	gitv1 "github.com/flanksource/git-operator/api/v1"
+	"github.com/flanksource/git-operator/connectors"
+	gitv5 "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	"sigs.k8s.io/kustomize/api/types"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	FileAdded    = "added"
+	FileModified = "modified"
+	FileDeleted  = "deleted"
+)
+
+// Plan is returned by /_plan and dry run requests, describing the commit a request would push
+type Plan struct {
+	Base   string     `json:"base"`
+	Branch string     `json:"branch"`
+	Title  string     `json:"title"`
+	Files  []PlanFile `json:"files"`
+	// How each object in the request would be saved
+	Objects []ObjectResult `json:"objects"`
+	// The resources added to or removed from each kustomization
+	Kustomizations []KustomizationChange `json:"kustomizations,omitempty"`
+	// The changes as a unified diff
+	Diff string `json:"diff"`
+}
+
+type PlanFile struct {
+	Path   string `json:"path"`
+	Action string `json:"action"`
+}
+
+type KustomizationChange struct {
+	Path    string   `json:"path"`
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+}
+
+// plan applies ops to a checkout of the branch of api and commits them locally to diff them, the
+// commit is never pushed and is discarded the next time the branch is checked out
+func plan(ctx context.Context, logger logr.Logger, git connectors.Connector, api *gitv1.GitopsAPI, ops ...operation) (*Plan, error) {
+	work, title, objects, err := applyOperations(ctx, logger, git, api, ops...)
+	if err != nil {
+		return nil, err
+	}
+	result := &Plan{
+		Base:    api.Spec.Base,
+		Branch:  api.Spec.Branch,
+		Title:   title,
+		Files:   []PlanFile{},
+		Objects: objects,
+	}
+	status, err := work.Status()
+	if err != nil {
+		return nil, err
+	}
+	if status.IsClean() {
+		return result, nil
+	}
+	hash, err := CreateCommit(api, work, title)
+	if err != nil {
+		return nil, err
+	}
+	repo, err := gitv5.PlainOpen(work.Filesystem.Root())
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open checkout")
+	}
+	commit, err := repo.CommitObject(plumbing.NewHash(hash))
+	if err != nil {
+		return nil, err
+	}
+	parent, err := commit.Parent(0)
+	if err != nil {
+		return nil, err
+	}
+	patch, err := parent.PatchContext(ctx, commit)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to diff changes")
+	}
+
+	result.Diff = patch.String()
+	for _, file := range patch.FilePatches() {
+		from, to := file.Files()
+		change := PlanFile{Action: FileModified}
+		switch {
+		case from == nil:
+			change = PlanFile{Path: to.Path(), Action: FileAdded}
+		case to == nil:
+			change = PlanFile{Path: from.Path(), Action: FileDeleted}
+		default:
+			change.Path = to.Path()
+		}
+		result.Files = append(result.Files, change)
+		if path.Base(change.Path) != "kustomization.yaml" {
+			continue
+		}
+		kustomization, err := diffKustomization(parent, commit, change.Path)
+		if err != nil {
+			return nil, err
+		}
+		result.Kustomizations = append(result.Kustomizations, *kustomization)
+	}
+	return result, nil
+}
+
+// diffKustomization compares the resources of the kustomization at file between two commits
+func diffKustomization(from, to *object.Commit, file string) (*KustomizationChange, error) {
+	before, err := readKustomization(from, file)
+	if err != nil {
+		return nil, err
+	}
+	after, err := readKustomization(to, file)
+	if err != nil {
+		return nil, err
+	}
+	change := &KustomizationChange{Path: file}
+	for _, resource := range after.Resources {
+		if findElement(before.Resources, resource) == -1 {
+			change.Added = append(change.Added, resource)
+		}
+	}
+	for _, resource := range before.Resources {
+		if findElement(after.Resources, resource) == -1 {
+			change.Removed = append(change.Removed, resource)
+		}
+	}
+	return change, nil
+}
+
+// readKustomization reads the kustomization at file in commit, returning an empty kustomization if it does not exist
+func readKustomization(commit *object.Commit, file string) (*types.Kustomization, error) {
+	kustomization := types.Kustomization{}
+	f, err := commit.File(file)
+	if err == object.ErrFileNotFound {
+		return &kustomization, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	contents, err := f.Contents()
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal([]byte(contents), &kustomization); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse %s", file)
+	}
+	return &kustomization, nil
+}
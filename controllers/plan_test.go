@@ -0,0 +1,66 @@
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	gitv1 "github.com/flanksource/git-operator/api/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+func TestPlan(t *testing.T) {
+	api := &gitv1.GitopsAPI{
+		ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default"},
+		Spec:       gitv1.GitopsAPISpec{Base: "master", Branch: "master"},
+	}
+	git := newFakeConnector(t)
+	master := git.remote["master"]
+
+	result, err := plan(context.Background(), logf.Log, git, api.DeepCopy(), configMapOperation(t, "a", false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := []PlanFile{{Path: "ConfigMap-default-a.yaml", Action: FileAdded}, {Path: "kustomization.yaml", Action: FileAdded}}
+	if !reflect.DeepEqual(result.Files, files) {
+		t.Errorf("expected %v, got %v", files, result.Files)
+	}
+	kustomizations := []KustomizationChange{{Path: "kustomization.yaml", Added: []string{"ConfigMap-default-a.yaml"}}}
+	if !reflect.DeepEqual(result.Kustomizations, kustomizations) {
+		t.Errorf("expected %v, got %v", kustomizations, result.Kustomizations)
+	}
+	if !strings.Contains(result.Diff, "+++ b/ConfigMap-default-a.yaml") || !strings.Contains(result.Diff, "+  key: a") {
+		t.Errorf("expected the diff to add the ConfigMap, got %s", result.Diff)
+	}
+	if len(git.pushed) != 0 || git.remote["master"] != master {
+		t.Errorf("expected nothing to be pushed, got %v", git.pushed)
+	}
+
+	// plan deleting an object that was committed
+	if _, err := newTestReconciler(t, api).commit(context.Background(), git, api, false, configMapOperation(t, "a", false)); err != nil {
+		t.Fatal(err)
+	}
+	result, err = plan(context.Background(), logf.Log, git, api.DeepCopy(), configMapOperation(t, "a", true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files = []PlanFile{{Path: "ConfigMap-default-a.yaml", Action: FileDeleted}, {Path: "kustomization.yaml", Action: FileModified}}
+	if !reflect.DeepEqual(result.Files, files) {
+		t.Errorf("expected %v, got %v", files, result.Files)
+	}
+	kustomizations = []KustomizationChange{{Path: "kustomization.yaml", Removed: []string{"ConfigMap-default-a.yaml"}}}
+	if !reflect.DeepEqual(result.Kustomizations, kustomizations) {
+		t.Errorf("expected %v, got %v", kustomizations, result.Kustomizations)
+	}
+
+	// nothing changes
+	result, err = plan(context.Background(), logf.Log, git, api.DeepCopy(), configMapOperation(t, "a", false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Files) != 0 || result.Diff != "" {
+		t.Errorf("expected no changes, got %v", result.Files)
+	}
+}
@@ -0,0 +1,147 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/flanksource/git-operator/connectors"
+	"github.com/labstack/echo"
+	"github.com/pkg/errors"
+)
+
+const (
+	ActionCreated   = "created"
+	ActionUpdated   = "updated"
+	ActionDeleted   = "deleted"
+	ActionUnchanged = "unchanged"
+)
+
+// ErrInvalidObjects is returned when the objects in a request cannot be parsed
+var ErrInvalidObjects = errors.New("invalid objects")
+
+// Result is the response to a request that was committed
+type Result struct {
+	// The commit pushed to the branch, empty if none of the objects changed
+	Commit         string `json:"commit,omitempty"`
+	Base           string `json:"base"`
+	Branch         string `json:"branch"`
+	PullRequest    int    `json:"pullRequest,omitempty"`
+	PullRequestURL string `json:"pullRequestURL,omitempty"`
+	// Set when the commit was pushed but no pull request was opened, because the provider does not support them
+	PullRequestsUnsupported bool           `json:"pullRequestsUnsupported,omitempty"`
+	Objects                 []ObjectResult `json:"objects"`
+}
+
+// ObjectResult describes how an object in the request was saved
+type ObjectResult struct {
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name"`
+	// The file the object was saved to or deleted from
+	Path string `json:"path"`
+	// One of created, updated, deleted or unchanged
+	Action string `json:"action"`
+}
+
+func (o ObjectResult) String() string {
+	return fmt.Sprintf("%s/%s/%s", o.Kind, o.Namespace, o.Name)
+}
+
+// ErrorResponse is the response to a request that failed
+type ErrorResponse struct {
+	// A machine readable reason matching the status code e.g. NotFound or Conflict
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+	// Set when the request failed after committing, e.g. when the commit was pushed but the pull request
+	// could not be opened
+	Result *Result `json:"result,omitempty"`
+}
+
+// gitHostError marks errors returned by the git host, when cloning, pushing or calling the provider API
+type gitHostError struct {
+	err error
+}
+
+func (e *gitHostError) Error() string {
+	return e.err.Error()
+}
+
+func (e *gitHostError) Unwrap() error {
+	return e.err
+}
+
+// operationError marks errors applying a single operation, index is the position of the operation in
+// the operations that were applied
+type operationError struct {
+	index int
+	err   error
+}
+
+func (e *operationError) Error() string {
+	return e.err.Error()
+}
+
+func (e *operationError) Unwrap() error {
+	return e.err
+}
+
+func hostError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &gitHostError{err: err}
+}
+
+// errorStatus returns the status code to respond with when a request fails
+func errorStatus(err error) int {
+	var httpError *echo.HTTPError
+	switch {
+	case errors.As(err, &httpError):
+		return httpError.Code
+	case errors.Is(err, ErrInvalidObjects), errors.Is(err, ErrInvalidTransaction):
+		return http.StatusBadRequest
+	case errors.Is(err, connectors.ErrNonFastForward):
+		return http.StatusConflict
+	case errors.Is(err, ErrObjectNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrInvalidPatch):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, ErrUnsupportedPatchType):
+		return http.StatusUnsupportedMediaType
+	case errors.Is(err, ErrJobQueueFull):
+		return http.StatusServiceUnavailable
+	case errors.As(err, new(*gitHostError)):
+		return http.StatusBadGateway
+	}
+	return http.StatusInternalServerError
+}
+
+func respondError(c echo.Context, err error) error {
+	return respondResultError(c, nil, err)
+}
+
+// respondResultError responds with an ErrorResponse including the result of the changes committed before err
+func respondResultError(c echo.Context, result *Result, err error) error {
+	status := errorStatus(err)
+	message := err.Error()
+	var httpError *echo.HTTPError
+	if errors.As(err, &httpError) {
+		message = fmt.Sprint(httpError.Message)
+	}
+	return c.JSON(status, ErrorResponse{
+		Reason:  strings.ReplaceAll(http.StatusText(status), " ", ""),
+		Message: message,
+		Result:  result,
+	})
+}
+
+// httpErrorHandler responds to errors returned by handlers, including routing errors, with an ErrorResponse
+func httpErrorHandler(err error, c echo.Context) {
+	if c.Response().Committed {
+		return
+	}
+	if err := respondError(c, err); err != nil {
+		c.Logger().Error(err)
+	}
+}
@@ -0,0 +1,77 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	OperationApply  = "apply"
+	OperationDelete = "delete"
+	OperationPatch  = "patch"
+)
+
+// ErrInvalidTransaction is returned when a /_transaction request cannot be parsed
+var ErrInvalidTransaction = errors.New("invalid transaction")
+
+// Transaction is the body of a /_transaction request, its operations are applied in order and committed together,
+// if any operation fails nothing is committed
+type Transaction struct {
+	Operations []TransactionOperation `json:"operations"`
+}
+
+type TransactionOperation struct {
+	// One of apply, delete or patch
+	Op string `json:"op"`
+	// The object to apply, or the object to delete or patch of which only the kind, namespace and name are used
+	Object map[string]interface{} `json:"object"`
+	// The content type of the patch, defaults to application/merge-patch+json
+	PatchType string          `json:"patchType,omitempty"`
+	Patch     json.RawMessage `json:"patch,omitempty"`
+}
+
+// parseTransaction parses a JSON or YAML transaction into operations
+func parseTransaction(body []byte) ([]operation, error) {
+	transaction := Transaction{}
+	if err := yaml.Unmarshal(body, &transaction); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidTransaction, err)
+	}
+	if len(transaction.Operations) == 0 {
+		return nil, fmt.Errorf("%w: no operations", ErrInvalidTransaction)
+	}
+	var ops []operation
+	for i, op := range transaction.Operations {
+		obj := &unstructured.Unstructured{Object: op.Object}
+		if obj.GetKind() == "" || obj.GetName() == "" {
+			return nil, fmt.Errorf("%w: operation %d: the object must have a kind and name", ErrInvalidTransaction, i)
+		}
+		switch op.Op {
+		case OperationApply, OperationDelete:
+			body, err := json.Marshal([]interface{}{op.Object})
+			if err != nil {
+				return nil, err
+			}
+			ops = append(ops, operation{delete: op.Op == OperationDelete, body: body, contentType: "application/json"})
+		case OperationPatch:
+			if op.PatchType == "" {
+				op.PatchType = string(k8stypes.MergePatchType)
+			}
+			if _, err := patchType(op.PatchType); err != nil {
+				return nil, err
+			}
+			target := &unstructured.Unstructured{}
+			target.SetKind(obj.GetKind())
+			target.SetNamespace(obj.GetNamespace())
+			target.SetName(obj.GetName())
+			ops = append(ops, operation{target: target, contentType: op.PatchType, body: op.Patch})
+		default:
+			return nil, fmt.Errorf("%w: operation %d: unknown op %q, expected apply, delete or patch", ErrInvalidTransaction, i, op.Op)
+		}
+	}
+	return ops, nil
+}
@@ -0,0 +1,81 @@
+package controllers
+
+import (
+	"errors"
+	"testing"
+
+	k8stypes "k8s.io/apimachinery/pkg/types"
+)
+
+func TestParseTransaction(t *testing.T) {
+	body := `
+operations:
+- op: apply
+  object:
+    apiVersion: v1
+    kind: ResourceQuota
+    metadata:
+      name: quota
+      namespace: tenant
+- op: delete
+  object:
+    kind: Namespace
+    metadata:
+      name: tenant
+- op: patch
+  object:
+    kind: ConfigMap
+    metadata:
+      name: tenants
+      namespace: default
+  patch:
+    data:
+      tenant: null
+- op: patch
+  patchType: application/json-patch+json
+  object:
+    kind: ConfigMap
+    metadata:
+      name: other
+  patch: [{"op": "remove", "path": "/data/tenant"}]
+`
+	ops, err := parseTransaction([]byte(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ops) != 4 {
+		t.Fatalf("expected 4 operations, got %d", len(ops))
+	}
+	if ops[0].delete || ops[0].target != nil || !ops[1].delete {
+		t.Errorf("expected an apply and a delete, got %+v %+v", ops[0], ops[1])
+	}
+	objs, err := parseOperations(ops[:2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objs[0]) != 1 || objs[0][0].GetKind() != "ResourceQuota" || len(objs[1]) != 1 || objs[1][0].GetName() != "tenant" {
+		t.Errorf("unexpected objects %v", objs)
+	}
+	if target := ops[2].target; target == nil || target.GetKind() != "ConfigMap" || target.GetNamespace() != "default" || target.GetName() != "tenants" {
+		t.Errorf("unexpected patch target %v", ops[2].target)
+	}
+	if ops[2].contentType != string(k8stypes.MergePatchType) || string(ops[2].body) != `{"data":{"tenant":null}}` {
+		t.Errorf("expected a merge patch, got %s %s", ops[2].contentType, ops[2].body)
+	}
+	if ops[3].contentType != string(k8stypes.JSONPatchType) || string(ops[3].body) != `[{"op":"remove","path":"/data/tenant"}]` {
+		t.Errorf("expected a json patch, got %s %s", ops[3].contentType, ops[3].body)
+	}
+
+	invalid := map[string]string{
+		"no operations":      `{"operations": []}`,
+		"malformed":          `{"operations": {}}`,
+		"unknown op":         `{"operations": [{"op": "create", "object": {"kind": "ConfigMap", "metadata": {"name": "a"}}}]}`,
+		"missing name":       `{"operations": [{"op": "apply", "object": {"kind": "ConfigMap"}}]}`,
+		"unknown patch type": `{"operations": [{"op": "patch", "patchType": "text/plain", "object": {"kind": "ConfigMap", "metadata": {"name": "a"}}}]}`,
+	}
+	for name, body := range invalid {
+		if _, err := parseTransaction([]byte(body)); !errors.Is(err, ErrInvalidTransaction) && !errors.Is(err, ErrUnsupportedPatchType) {
+			t.Errorf("%s: expected an invalid transaction, got %v", name, err)
+		}
+	}
+}
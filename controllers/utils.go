@@ -3,9 +3,11 @@ package controllers
 import (
 	"bytes"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"unicode"
 
 	"github.com/go-git/go-billy/v5"
@@ -13,6 +15,26 @@ import (
 	"github.com/pkg/errors"
 )
 
+var (
+	branchLocksLock sync.Mutex
+	// branchLocks serializes requests pushing to the same repository and branch
+	branchLocks = map[string]*sync.Mutex{}
+)
+
+// lockBranch waits for any other request pushing to branch of repository and returns a func to unlock it,
+// branch is the untemplated spec.branch so that requests which template to different branches are still serialized
+func lockBranch(repository, branch string) func() {
+	key := repository + "#" + branch
+	branchLocksLock.Lock()
+	if _, found := branchLocks[key]; !found {
+		branchLocks[key] = &sync.Mutex{}
+	}
+	lock := branchLocks[key]
+	branchLocksLock.Unlock()
+	lock.Lock()
+	return lock.Unlock
+}
+
 func copy(data []byte, path string, fs billy.Filesystem, work *gitv5.Worktree) error {
 	dst, err := openOrCreate(path, fs)
 	if err != nil {
@@ -29,9 +51,8 @@ func copy(data []byte, path string, fs billy.Filesystem, work *gitv5.Worktree) e
 	return errors.Wrap(err, "failed to add to git")
 }
 
-func deleteFile(path string, work *gitv5.Worktree, repoRoot string) error {
-	fullPath := filepath.Join(repoRoot, path)
-	err := os.Remove(fullPath)
+func deleteFile(path string, work *gitv5.Worktree, fs billy.Filesystem) error {
+	err := fs.Remove(path)
 	if err != nil {
 		return errors.Wrap(err, "failed to delete file")
 	}
@@ -46,6 +67,43 @@ func openOrCreate(path string, fs billy.Filesystem) (billy.File, error) {
 	return fs.Create(path)
 }
 
+func readFile(fs billy.Filesystem, path string) ([]byte, error) {
+	file, err := fs.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close() // nolint: errcheck
+	return ioutil.ReadAll(file)
+}
+
+// walk is the billy.Filesystem equivalent of filepath.Walk
+func walk(fs billy.Filesystem, root string, walkFn filepath.WalkFunc) error {
+	info, err := fs.Lstat(root)
+	if err != nil {
+		return walkFn(root, nil, err)
+	}
+	return walkDir(fs, root, info, walkFn)
+}
+
+func walkDir(fs billy.Filesystem, path string, info os.FileInfo, walkFn filepath.WalkFunc) error {
+	if !info.IsDir() {
+		return walkFn(path, info, nil)
+	}
+	infos, err := fs.ReadDir(path)
+	if err := walkFn(path, info, err); err != nil {
+		if err == filepath.SkipDir {
+			return nil
+		}
+		return err
+	}
+	for _, child := range infos {
+		if err := walkDir(fs, filepath.Join(path, child.Name()), child, walkFn); err != nil && err != filepath.SkipDir {
+			return err
+		}
+	}
+	return nil
+}
+
 func findElement(list []string, element string) int {
 	for i := range list {
 		if list[i] == element {
@@ -0,0 +1,62 @@
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	gitv1 "github.com/flanksource/git-operator/api/v1"
+	"github.com/flanksource/git-operator/connectors"
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestLockBranch(t *testing.T) {
+	unlock := lockBranch("https://github.com/flanksource/git-operator", "master")
+	locked := make(chan struct{})
+	go func() {
+		defer lockBranch("https://github.com/flanksource/git-operator", "master")()
+		close(locked)
+	}()
+	// other branches and repositories are not blocked
+	lockBranch("https://github.com/flanksource/git-operator", "feature")()
+	lockBranch("https://github.com/flanksource/kommons", "master")()
+
+	select {
+	case <-locked:
+		t.Fatal("expected the branch to stay locked")
+	case <-time.After(100 * time.Millisecond):
+	}
+	unlock()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatal("expected the branch to be unlocked")
+	}
+}
+
+func TestCommitRetriesRejectedPush(t *testing.T) {
+	api := &gitv1.GitopsAPI{
+		ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default"},
+		Spec: gitv1.GitopsAPISpec{
+			GitRepository: "https://github.com/flanksource/git-operator",
+			Base:          "master",
+			Branch:        "master",
+		},
+	}
+	r := newTestReconciler(t, api)
+	git := newFakeConnector(t)
+	// another replica pushed to the branch since it was cloned
+	git.pushErrs = []error{errors.Wrap(connectors.ErrNonFastForward, "failed to push")}
+	result, err := r.commit(context.Background(), git, api, false, configMapOperation(t, "a", false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Commit == "" {
+		t.Error("expected a commit")
+	}
+	if !reflect.DeepEqual(git.pushed, []string{"master:master", "master:master"}) {
+		t.Errorf("expected the push to be retried, got %v", git.pushed)
+	}
+}
@@ -3,6 +3,7 @@ module github.com/flanksource/git-operator
 go 1.17
 
 require (
+	github.com/evanphx/json-patch v4.9.0+incompatible
 	github.com/flanksource/commons v1.5.6
 	github.com/flanksource/kommons v0.20.1
 	github.com/go-git/go-billy/v5 v5.0.0
@@ -56,7 +57,6 @@ require (
 	github.com/dustin/gojson v0.0.0-20160307161227-2e71ec9dd5ad // indirect
 	github.com/emicklei/go-restful v2.9.5+incompatible // indirect
 	github.com/emirpasic/gods v1.12.0 // indirect
-	github.com/evanphx/json-patch v4.9.0+incompatible // indirect
 	github.com/fatih/color v1.9.0 // indirect
 	github.com/ghodss/yaml v1.0.0 // indirect
 	github.com/go-errors/errors v1.0.1 // indirect
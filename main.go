@@ -18,19 +18,25 @@ package main
 
 import (
 	"flag"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
 	zapu "go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
 	gitv1 "github.com/flanksource/git-operator/api/v1"
+	"github.com/flanksource/git-operator/connectors"
 	"github.com/flanksource/git-operator/controllers"
 	// +kubebuilder:scaffold:imports
 )
@@ -66,20 +72,59 @@ func logLevelFromString(logLevel string) *zapu.AtomicLevel {
 	return &ll
 }
 
+// operatorNamespace returns the namespace the operator runs in, or an empty string outside of a cluster
+func operatorNamespace() string {
+	if namespace := os.Getenv("POD_NAMESPACE"); namespace != "" {
+		return namespace
+	}
+	namespace, err := ioutil.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/namespace")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(namespace))
+}
+
 func main() {
 	var metricsAddr string
 	var enableLeaderElection bool
 	var syncPeriod time.Duration
+	var knownHostsConfigMap string
+	var workers int
 	flag.StringVar(&metricsAddr, "metrics-addr", ":8080", "The address the metric endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "enable-leader-election", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
 	flag.DurationVar(&syncPeriod, "sync-period", 60*time.Second, "The resync period used to check Github for new resources")
 	flag.StringVar(&logLevel, "log-level", "error", "Logging level: debug, info, error")
+	flag.StringVar(&connectors.CacheDir, "cache-dir", filepath.Join(os.TempDir(), "git-operator"), "The directory repositories are cached in between requests, set to an empty string to clone on every request")
+	flag.DurationVar(&connectors.CacheMaxAge, "cache-max-age", 24*time.Hour, "Cached repositories that were not used for this long are removed from --cache-dir, 0 keeps them forever")
+	flag.IntVar(&connectors.CloneDepth, "clone-depth", 0, "Limit clones and fetches to this many commits of history for all repositories, 0 fetches the full history. Azure DevOps repositories are always cloned in full. The whole tree is checked out, sparse checkouts are not supported")
+	flag.IntVar(&workers, "workers", 4, "The number of asynchronous requests and batches committed concurrently")
+	flag.StringVar(&knownHostsConfigMap, "known-hosts-configmap", "", "The name of a ConfigMap in the operator namespace with a known_hosts key, used to verify SSH host keys when the credentials secret has no SSH_KNOWN_HOSTS. Outside of a cluster it must be namespace/name")
 	flag.Parse()
 
 	ctrl.SetLogger(zap.New(zap.UseDevMode(true), zap.Level(logLevelFromString(logLevel))))
 
+	if knownHostsConfigMap != "" {
+		// the operator can only read ConfigMaps in its own namespace
+		namespace := operatorNamespace()
+		parts := strings.Split(knownHostsConfigMap, "/")
+		switch {
+		case len(parts) == 1 && namespace == "":
+			setupLog.Error(nil, "invalid --known-hosts-configmap, the operator namespace is unknown so it must be namespace/name", "value", knownHostsConfigMap)
+			os.Exit(1)
+		case len(parts) == 1:
+			parts = []string{namespace, parts[0]}
+		case len(parts) != 2:
+			setupLog.Error(nil, "invalid --known-hosts-configmap, expected name or namespace/name", "value", knownHostsConfigMap)
+			os.Exit(1)
+		case namespace != "" && parts[0] != namespace:
+			setupLog.Error(nil, "invalid --known-hosts-configmap, the ConfigMap must be in the operator namespace", "value", knownHostsConfigMap, "namespace", namespace)
+			os.Exit(1)
+		}
+		connectors.KnownHostsConfigMap = &types.NamespacedName{Namespace: parts[0], Name: parts[1]}
+	}
+
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
 		Scheme:             scheme,
 		MetricsBindAddress: metricsAddr,
@@ -94,9 +139,10 @@ func main() {
 	}
 
 	if err = (&controllers.GitopsAPIReconciler{
-		Client: mgr.GetClient(),
-		Log:    ctrl.Log.WithName("controllers").WithName("GitopsAPI"),
-		Scheme: mgr.GetScheme(),
+		Client:  mgr.GetClient(),
+		Log:     ctrl.Log.WithName("controllers").WithName("GitopsAPI"),
+		Scheme:  mgr.GetScheme(),
+		Workers: workers,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "GitopsAPI")
 		os.Exit(1)
@@ -104,8 +150,17 @@ func main() {
 
 	// +kubebuilder:scaffold:builder
 
+	stop := ctrl.SetupSignalHandler()
+	if connectors.CacheDir != "" && connectors.CacheMaxAge > 0 {
+		interval := connectors.CacheMaxAge
+		if interval > time.Hour {
+			interval = time.Hour
+		}
+		go wait.Until(func() { connectors.EvictCache(ctrl.Log.WithName("cache")) }, interval, stop)
+	}
+
 	setupLog.Info("starting manager")
-	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
+	if err := mgr.Start(stop); err != nil {
 		setupLog.Error(err, "problem running manager")
 		os.Exit(1)
 	}
@@ -126,8 +126,9 @@ func main() {
 }
 
 func TestGitopsAPICreate(ctx context.Context, test *console.TestResults) error {
-	git, err := connectors.NewConnector(ctx, crdK8s, k8s, log, "platform-system", "https://github.com/"+repository, &v1.LocalObjectReference{
-		Name: "github",
+	git, err := connectors.NewConnector(ctx, crdK8s, k8s, log, "platform-system", &gitv1.GitopsAPISpec{
+		GitRepository: "https://github.com/" + repository,
+		SecretRef:     &v1.LocalObjectReference{Name: "github"},
 	})
 	if err != nil {
 		return err
@@ -184,8 +185,9 @@ func TestGitopsAPICreate(ctx context.Context, test *console.TestResults) error {
 }
 
 func TestGitopsAPIOrUpdate(ctx context.Context, test *console.TestResults) error {
-	git, err := connectors.NewConnector(ctx, crdK8s, k8s, log, "platform-system", "https://github.com/"+repository, &v1.LocalObjectReference{
-		Name: "github",
+	git, err := connectors.NewConnector(ctx, crdK8s, k8s, log, "platform-system", &gitv1.GitopsAPISpec{
+		GitRepository: "https://github.com/" + repository,
+		SecretRef:     &v1.LocalObjectReference{Name: "github"},
 	})
 	if err != nil {
 		return err
@@ -267,8 +269,9 @@ func TestGitopsAPIOrUpdate(ctx context.Context, test *console.TestResults) error
 }
 
 func TestGitopsAPIDelete(ctx context.Context, test *console.TestResults) error {
-	git, err := connectors.NewConnector(ctx, crdK8s, k8s, log, "platform-system", "https://github.com/"+repository, &v1.LocalObjectReference{
-		Name: "github",
+	git, err := connectors.NewConnector(ctx, crdK8s, k8s, log, "platform-system", &gitv1.GitopsAPISpec{
+		GitRepository: "https://github.com/" + repository,
+		SecretRef:     &v1.LocalObjectReference{Name: "github"},
 	})
 	if err != nil {
 		return err
@@ -325,8 +328,9 @@ func TestGitopsAPIDelete(ctx context.Context, test *console.TestResults) error {
 }
 
 func TestGitopsAPIDeleteMultiple(ctx context.Context, test *console.TestResults) error {
-	git, err := connectors.NewConnector(ctx, crdK8s, k8s, log, "platform-system", "https://github.com/"+repository, &v1.LocalObjectReference{
-		Name: "github",
+	git, err := connectors.NewConnector(ctx, crdK8s, k8s, log, "platform-system", &gitv1.GitopsAPISpec{
+		GitRepository: "https://github.com/" + repository,
+		SecretRef:     &v1.LocalObjectReference{Name: "github"},
 	})
 	if err != nil {
 		return err